@@ -2,10 +2,21 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/JanDeVisser/finn/handler"
 	"github.com/JanDeVisser/finn/model"
 	"github.com/JanDeVisser/finn/tximport"
 	"github.com/JanDeVisser/grumble"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 var mgr *grumble.EntityManager
@@ -28,6 +39,33 @@ func TestImportSchema(t *testing.T) {
 	}
 }
 
+func TestImportProfiles(t *testing.T) {
+	if _, err := tximport.MigrateImportProfiles(mgr, "data"); err != nil {
+		t.Fatal(err)
+	}
+	acc, err := model.GetAccountByName(mgr, "ManulifeOne")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := tximport.GetImportProfile(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile == nil {
+		t.Fatal("No import profile migrated for ManulifeOne")
+	}
+	data, err := profile.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if templates, ok := data["templates"].([]interface{}); !ok || len(templates) == 0 {
+		t.Errorf("Migrated profile has no templates")
+	}
+	if _, err = tximport.AddTemplate(acc, map[string]interface{}{"template": "(", "category": "Cash"}); err == nil {
+		t.Errorf("Adding a template with an invalid regular expression succeeded")
+	}
+}
+
 func TestCSVImport(t *testing.T) {
 	var err error
 	err = mgr.TX(func(db *sql.DB) (err error) {
@@ -46,3 +84,1722 @@ func TestCSVImport(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCSVImportTransfers(t *testing.T) {
+	acc, err := model.GetAccountByName(mgr, "RBC VISA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := mgr.MakeQuery(&model.TransferTx{})
+	q.AddCondition(grumble.HasParent{Parent: acc.AsKey()})
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Fatal("No transfers booked against RBC VISA")
+	}
+	for _, row := range results {
+		tx := row[0].(*model.TransferTx)
+		if tx.CrossPost == nil || tx.Account == nil {
+			t.Errorf("Transfer %q is not cross-posted", tx.Description)
+		}
+		if tx.Amt <= 0 {
+			t.Errorf("Transfer %q should be a credit to RBC VISA, not %s", tx.Description, tx.Amt)
+		}
+	}
+}
+
+func TestMatchTransfers(t *testing.T) {
+	acc := makeTestAccount(t, "Match", 0)
+	counter := makeTestAccount(t, "Match Counter", 0)
+	// Amounts which do not occur anywhere else in the database.
+	unique := model.Money(time.Now().UnixNano()%1000000) * 100
+	pair := model.MoneyFromFloat(1000000) + unique
+	ambiguous := model.MoneyFromFloat(2000000) + unique
+	debit := addTestTransaction(t, acc, time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC), -pair, "Pay VISA")
+	addTestTransaction(t, counter, time.Date(2019, 5, 2, 0, 0, 0, 0, time.UTC), pair, "Payment, thank you")
+	credit := addTestTransaction(t, acc, time.Date(2019, 5, 10, 0, 0, 0, 0, time.UTC), ambiguous, "Refund")
+	addTestTransaction(t, counter, time.Date(2019, 5, 9, 0, 0, 0, 0, time.UTC), -ambiguous, "Refund 1")
+	addTestTransaction(t, counter, time.Date(2019, 5, 11, 0, 0, 0, 0, time.UTC), -ambiguous, "Refund 2")
+
+	match := tximport.MakeTransferMatch(acc, tximport.DefaultMatchWindow)
+	if err := match.Run(mgr); err != nil {
+		t.Fatal(err)
+	}
+	if match.Matched != 1 {
+		t.Errorf("Matched %d transfers, expected 1", match.Matched)
+	}
+	if len(match.Ambiguous) != 1 || match.Ambiguous[0].Transaction.Id() != credit.Id() || len(match.Ambiguous[0].Candidates) != 2 {
+		t.Errorf("Expected the refund to be ambiguous with 2 candidates: %s", match)
+	}
+
+	q := mgr.MakeQuery(&model.TransferTx{})
+	q.AddCondition(grumble.HasParent{Parent: acc.AsKey()})
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 transfer in %q, got %d", acc.AccName, len(results))
+	}
+	transfer := results[0][0].(*model.TransferTx)
+	if transfer.Amt != -pair || transfer.Description != debit.Description || transfer.CrossPost == nil ||
+		transfer.Account == nil || transfer.Account.Id() != counter.Id() {
+		t.Fatalf("Transfer %q is not cross-posted to %q", transfer.Description, counter.AccName)
+	}
+	e, err := mgr.Get(model.TransferTx{}, transfer.CrossPost.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cross, ok := e.(*model.TransferTx)
+	if !ok || cross == nil {
+		t.Fatalf("Other side of transfer %q not found", transfer.Description)
+	}
+	if cross.Parent().Id() != counter.Id() || cross.Amt != pair || cross.CrossPost == nil ||
+		cross.CrossPost.Id() != transfer.Id() || cross.Account == nil || cross.Account.Id() != acc.Id() {
+		t.Errorf("Other side of transfer %q is not cross-posted back", transfer.Description)
+	}
+	if e, err = mgr.Get(model.Transaction{}, debit.Id()); err == nil && e != nil && model.TransactionOf(e) != nil {
+		t.Errorf("Matched transaction %q was not replaced by the transfer", debit.Description)
+	}
+}
+
+func TestUndoImport(t *testing.T) {
+	acc := makeTestAccount(t, "Undo", 0)
+	counter := makeTestAccount(t, "Undo Counter", 0)
+	unique := model.Money(time.Now().UnixNano()%1000000) * 100
+	pair := model.MoneyFromFloat(3000000) + unique
+	data := fmt.Sprintf(`!Type:Bank
+D05/01'19
+T-%s
+PPAY VISA
+^
+D05/03'19
+T-12.34
+PCOFFEE
+^
+`, pair)
+	txImport := importData(t, acc, "QIF", data)
+	if txImport.Good != 2 {
+		t.Fatalf("Expected 2 imported transactions, got %d: %s", txImport.Good, txImport.Errors)
+	}
+	addTestTransaction(t, counter, time.Date(2019, 5, 2, 0, 0, 0, 0, time.UTC), pair, "Payment, thank you")
+	match := tximport.MakeTransferMatch(acc, tximport.DefaultMatchWindow)
+	if err := match.Run(mgr); err != nil {
+		t.Fatal(err)
+	}
+	if match.Matched != 1 {
+		t.Fatalf("Matched %d transfers, expected 1", match.Matched)
+	}
+
+	deleted, err := txImport.Undo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 || txImport.Status != tximport.Undone {
+		t.Errorf("Undo deleted %d transactions with status %s, expected 2 and %s", deleted, txImport.Status, tximport.Undone)
+	}
+	imported, err := model.GetImportedTransactions(mgr, txImport.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 0 {
+		t.Errorf("%d imported transactions left after undo", len(imported))
+	}
+	txs, err := acc.GetTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range txs {
+		if tx != nil && tx.TXType != model.OpeningBalance {
+			t.Errorf("Transaction %q left in %q after undo", tx.Description, acc.AccName)
+		}
+	}
+
+	q := mgr.MakeQuery(&model.TransferTx{})
+	q.AddCondition(grumble.HasParent{Parent: counter.AsKey()})
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Errorf("%d transfers left in %q after undo", len(results), counter.AccName)
+	}
+	if txs, err = counter.GetTransactions(); err != nil {
+		t.Fatal(err)
+	}
+	plain := 0
+	for _, tx := range txs {
+		if tx == nil || tx.TXType == model.OpeningBalance {
+			continue
+		}
+		plain++
+		if tx.TXType != model.Credit || tx.Amt != pair || tx.Description != "Payment, thank you" {
+			t.Errorf("Counterpart is %s %q %s, expected a plain credit of %s", tx.TXType, tx.Description, tx.Amt, pair)
+		}
+	}
+	if plain != 1 {
+		t.Errorf("%d transactions in %q after undo, expected 1", plain, counter.AccName)
+	}
+}
+
+func TestPayPalFunding(t *testing.T) {
+	rows := [][]string{
+		{"01/03/2019", "10:00:00", "EST", "Shop A", "Express Checkout Payment", "Completed", "USD", "-10.00", "P1", ""},
+		{"01/03/2019", "10:00:00", "EST", "Shop B", "Express Checkout Payment", "Completed", "USD", "-20.00", "P2", ""},
+		{"01/03/2019", "10:00:00", "EST", "", "General Currency Conversion", "Completed", "CAD", "-26.50", "C1", "P2"},
+		{"01/03/2019", "10:00:00", "EST", "", "General Currency Conversion", "Completed", "USD", "20.00", "C2", "P2"},
+		{"01/03/2019", "10:00:00", "EST", "", "General Currency Conversion", "Completed", "CAD", "-13.20", "C3", "P1"},
+		{"01/03/2019", "10:00:00", "EST", "", "General Currency Conversion", "Completed", "USD", "10.00", "C4", "P1"},
+	}
+	export := func(columns int) string {
+		header := []string{"Date", "Time", "TimeZone", "Name", "Type", "Status", "Currency", "Amount", "Transaction ID", "Reference Txn ID"}
+		lines := []string{strings.Join(header[:columns], ",")}
+		for _, row := range rows {
+			lines = append(lines, strings.Join(row[:columns], ","))
+		}
+		return strings.Join(lines, "\n") + "\n"
+	}
+	payPalAccount := func(name string) *model.Account {
+		acc := makeTestAccount(t, name, 0)
+		profile := &tximport.ImportProfile{Config: `{"dateformat": "%d/%m/%Y"}`}
+		profile.Initialize(acc, 0)
+		if err := mgr.Put(profile); err != nil {
+			t.Fatal(err)
+		}
+		return acc
+	}
+
+	acc := payPalAccount("PayPal Funding")
+	txImport := importData(t, acc, "PayPal", export(10))
+	if txImport.Good != 2 || txImport.Bad != 0 {
+		t.Fatalf("Expected 2 good payments, got %d good and %d bad: %s", txImport.Good, txImport.Bad, txImport.Errors)
+	}
+	txs, err := acc.GetTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][2]model.Money{
+		"Shop A": {model.MoneyFromFloat(-13.20), model.MoneyFromFloat(-10)},
+		"Shop B": {model.MoneyFromFloat(-26.50), model.MoneyFromFloat(-20)},
+	}
+	for _, tx := range txs {
+		if amts, ok := expected[tx.Description]; ok {
+			if tx.Amt != amts[0] || tx.ForeignAmt != amts[1] {
+				t.Errorf("%q booked as %s (%s USD), expected %s (%s USD)", tx.Description, tx.Amt, tx.ForeignAmt, amts[0], amts[1])
+			}
+			delete(expected, tx.Description)
+		}
+	}
+	if len(expected) > 0 {
+		t.Errorf("Payments not booked: %v", expected)
+	}
+
+	// Without transaction IDs the funding rows cannot be paired up.
+	acc = payPalAccount("PayPal Unpaired")
+	txImport = importData(t, acc, "PayPal", export(8))
+	if txImport.Good != 0 || txImport.Bad != 2 {
+		t.Errorf("Expected both payments to fail, got %d good and %d bad", txImport.Good, txImport.Bad)
+	}
+}
+
+func TestPayPalImport(t *testing.T) {
+	var err error
+	err = mgr.TX(func(db *sql.DB) (err error) {
+		acc, err := model.GetAccountByName(mgr, "Paypal")
+		if err != nil {
+			return
+		}
+		txImport, err := tximport.MakeTXImport(acc, "data/Paypal_03062018.CSV")
+		if err != nil {
+			return
+		}
+		if err = txImport.Read(); err != nil {
+			return
+		}
+		if txImport.Good == 0 || txImport.Bad > 0 {
+			t.Errorf("PayPal import: %d good, %d bad: %s", txImport.Good, txImport.Bad, txImport.Errors)
+		}
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+const ofxSGML = `OFXHEADER:100
+DATA:OFXSGML
+VERSION:102
+
+<OFX>
+<BANKMSGSRSV1><STMTTRNRS><STMTRS>
+<CURDEF>CAD
+<BANKACCTFROM><ACCTID>123456789</BANKACCTFROM>
+<BANKTRANLIST>
+<STMTTRN><TRNTYPE>DEBIT<DTPOSTED>20190102120000[-5:EST]<TRNAMT>-28.25<FITID>90000001<NAME>POS RICKS PRO SHOP</STMTTRN>
+<STMTTRN><TRNTYPE>CREDIT<DTPOSTED>20190103<TRNAMT>100.00<FITID>90000002<NAME>CTC CANADA &amp; CO</STMTTRN>
+</BANKTRANLIST>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>`
+
+const ofxXML = `<?xml version="1.0" encoding="UTF-8"?>
+<?OFX OFXHEADER="200" VERSION="211"?>
+<OFX><BANKMSGSRSV1><STMTTRNRS><STMTRS>
+<CURDEF>CAD</CURDEF>
+<BANKTRANLIST>
+<STMTTRN><TRNTYPE>DEBIT</TRNTYPE><DTPOSTED>20190102</DTPOSTED><TRNAMT>-28.25</TRNAMT><FITID>90000001</FITID><NAME>POS RICKS PRO SHOP</NAME></STMTTRN>
+<STMTTRN><TRNTYPE>CREDIT</TRNTYPE><DTPOSTED>20190103</DTPOSTED><TRNAMT>100.00</TRNAMT><FITID>90000002</FITID><NAME>CTC CANADA &amp; CO</NAME></STMTTRN>
+</BANKTRANLIST>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1></OFX>`
+
+func TestParseOFX(t *testing.T) {
+	for _, data := range []string{ofxSGML, ofxXML} {
+		root, err := tximport.ParseOFX(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trns := root.FindAll("STMTTRN")
+		if len(trns) != 2 {
+			t.Fatalf("Expected 2 STMTTRN elements, got %d", len(trns))
+		}
+		if trns[0].Get("TRNAMT") != "-28.25" || trns[1].Get("NAME") != "CTC CANADA & CO" {
+			t.Errorf("Unexpected STMTTRN values %q, %q", trns[0].Get("TRNAMT"), trns[1].Get("NAME"))
+		}
+		if d, err := tximport.ParseOFXDate(trns[0].Get("DTPOSTED")); err != nil || d.Day() != 2 {
+			t.Errorf("Could not parse DTPOSTED %q: %v", trns[0].Get("DTPOSTED"), err)
+		}
+	}
+}
+
+const ofxForeign = `OFXHEADER:100
+DATA:OFXSGML
+VERSION:102
+
+<OFX>
+<BANKMSGSRSV1><STMTTRNRS><STMTRS>
+<CURDEF>CAD
+<BANKTRANLIST>
+<STMTTRN><TRNTYPE>DEBIT<DTPOSTED>20190104<TRNAMT>-10.00<FITID>90000011<NAME>AMAZON.COM<CURRENCY><CURRATE>1.3<CURSYM>USD</CURRENCY></STMTTRN>
+<STMTTRN><TRNTYPE>DEBIT<DTPOSTED>20190105<TRNAMT>-26.00<FITID>90000012<NAME>HOTEL NEW YORK<ORIGCURRENCY><CURRATE>1.3<CURSYM>USD</ORIGCURRENCY></STMTTRN>
+</BANKTRANLIST>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>`
+
+// importData imports data into the account using the given importer, through
+// a temporary file.
+func importData(t *testing.T, acc *model.Account, importer string, data string) *tximport.TXImport {
+	dir, err := ioutil.TempDir("", "finn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "statement")
+	if err = ioutil.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	acc.Importer = importer
+	if err = mgr.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	txImport, err := tximport.MakeTXImport(acc, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = txImport.Read(); err != nil {
+		t.Fatal(err)
+	}
+	return txImport
+}
+
+func TestOFXForeignCurrency(t *testing.T) {
+	acc := makeTestAccount(t, "OFX Foreign", 0)
+	txImport := importData(t, acc, "OFX", ofxForeign)
+	txs, err := model.GetImportedTransactions(mgr, txImport.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][2]float64{
+		"90000011": {-13, -10},
+		"90000012": {-26, -20},
+	}
+	if len(txs) != len(expected) {
+		t.Fatalf("Expected %d transactions, got %d", len(expected), len(txs))
+	}
+	for _, e := range txs {
+		tx := model.TransactionOf(e)
+		amts := expected[tx.ExternalId]
+		if tx.Currency != "USD" || tx.Amt != model.MoneyFromFloat(amts[0]) || tx.ForeignAmt != model.MoneyFromFloat(amts[1]) {
+			t.Errorf("%s: %s, %s %s; expected %.2f, USD %.2f", tx.Description, tx.Amt, tx.Currency, tx.ForeignAmt, amts[0], amts[1])
+		}
+	}
+}
+
+const qifData = `!Type:Bank
+D01/02'19
+T-76.24
+PPAY VISA ROYAL BANK OF CANADA
+L[RBC VISA]
+^
+D01/03'19
+T-110.00
+PSOBEYS
+SFood:Groceries
+$-80.00
+SHousehold/Kitchener
+EDish soap
+$-30.00
+^
+`
+
+func TestParseQIF(t *testing.T) {
+	records, err := tximport.ParseQIF(qifData, "ManulifeOne")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 QIF records, got %d", len(records))
+	}
+	if _, _, transfer := tximport.ParseQIFCategory(records[0].Category); transfer != "RBC VISA" {
+		t.Errorf("Expected transfer to RBC VISA, got %q", transfer)
+	}
+	if len(records[1].Splits) != 2 {
+		t.Fatalf("Expected 2 splits, got %d", len(records[1].Splits))
+	}
+	category, project, _ := tximport.ParseQIFCategory(records[1].Splits[1].Category)
+	if category != "Household" || project != "Kitchener" {
+		t.Errorf("Unexpected split category %q, project %q", category, project)
+	}
+}
+
+func TestQIFSplits(t *testing.T) {
+	acc := makeTestAccount(t, "QIF Splits", 0)
+	counter := makeTestAccount(t, "QIF Splits Counter", 0)
+	e, err := counter.MakeTransaction(model.Transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := e.(*model.TransferTx)
+	transfer.Date = time.Date(2019, 1, 3, 0, 0, 0, 0, time.UTC)
+	transfer.Amt = model.MoneyFromFloat(30)
+	transfer.Description = "Booked from the counter account"
+	if err = counter.Transfer(transfer, acc); err != nil {
+		t.Fatal(err)
+	}
+
+	data := fmt.Sprintf(`!Type:Bank
+D01/03'19
+T-110.00
+PSOBEYS
+SFood:Groceries
+$-80.00
+S[%s]
+$-30.00
+^
+D01/04'19
+T-110.00
+PSOBEYS
+SFood:Groceries
+$-80.00
+S[No Such Account]
+$-30.00
+^
+`, counter.AccName)
+	txImport := importData(t, acc, "QIF", data)
+	if txImport.Good != 1 || txImport.Bad != 1 {
+		t.Errorf("Expected 1 good and 1 bad record, got %d and %d", txImport.Good, txImport.Bad)
+	}
+	txs, err := model.GetImportedTransactions(mgr, txImport.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 {
+		t.Fatalf("Expected only the groceries split of the first record, got %d transactions", len(txs))
+	}
+	if tx := model.TransactionOf(txs[0]); tx.Amt != model.MoneyFromFloat(-80) || tx.Date.Day() != 3 {
+		t.Errorf("Unexpected transaction %s on %s", tx.Amt, tx.Date)
+	}
+}
+
+func TestIngester(t *testing.T) {
+	root, err := ioutil.TempDir("", "finn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	acc := makeTestAccount(t, "Ingest", 0)
+	acc.Importer = "QIF"
+	if err = mgr.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	queue := filepath.Join(root, acc.AccName, tximport.QueueDir)
+	if err = os.MkdirAll(queue, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(queue, "statement.qif")
+	if err = ioutil.WriteFile(fileName, []byte("!Type:Bank\nD01/03'19\nT-10.00\nPCOFFEE\n^\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(fileName, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	// A file where the done directory should be makes moving the file fail.
+	done := filepath.Join(root, acc.AccName, tximport.DoneDir)
+	if err = ioutil.WriteFile(done, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	imports := func() int {
+		imports, err := tximport.GetImports(acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(imports)
+	}
+	ingester := tximport.MakeIngester(root, time.Minute)
+	for i := 0; i < 2; i++ {
+		if err = ingester.Scan(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := imports(); n != 1 {
+		t.Fatalf("File which could not be moved was imported %d times, expected once", n)
+	}
+	if _, err = os.Stat(fileName); err != nil {
+		t.Fatalf("File which could not be moved is gone: %s", err)
+	}
+
+	if err = os.Remove(done); err != nil {
+		t.Fatal(err)
+	}
+	modTime = modTime.Add(time.Minute)
+	if err = os.Chtimes(fileName, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err = ingester.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	if n := imports(); n != 2 {
+		t.Errorf("Changed file was imported %d times, expected twice", n)
+	}
+	if _, err = os.Stat(filepath.Join(done, "statement.qif")); err != nil {
+		t.Errorf("Changed file was not moved to the done directory: %s", err)
+	}
+}
+
+func TestRerunImport(t *testing.T) {
+	acc := makeTestAccount(t, "Rerun", 0)
+	counterName := fmt.Sprintf("Rerun Counter %d", time.Now().UnixNano())
+	data := fmt.Sprintf(`!Type:Bank
+D01/02'19
+T-76.24
+PPAY VISA
+L[%s]
+^
+D01/03'19
+T-10.00
+PCOFFEE
+^
+`, counterName)
+	txImport := importData(t, acc, "QIF", data)
+	if txImport.Good != 1 || txImport.Bad != 1 {
+		t.Fatalf("Expected 1 good and 1 bad record, got %d and %d", txImport.Good, txImport.Bad)
+	}
+	lineErrors, err := txImport.GetLineErrors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lineErrors) != 1 || len(lineErrors[0].Fields()) == 0 {
+		t.Fatalf("Expected 1 line error with the raw fields of the line, got %d", len(lineErrors))
+	}
+	if msgs := txImport.ErrorLines(); len(msgs) != 1 || !strings.HasPrefix(msgs[0], fmt.Sprintf("Line %d: ", lineErrors[0].Line)) {
+		t.Errorf("Expected the line error in the import errors, got %q", msgs)
+	}
+
+	// A re-run which fails leaves the import and its line errors as they were.
+	stored := txImport.Data
+	txImport.Data = strings.Repeat("X", 100000)
+	if err = txImport.Rerun(); err == nil {
+		t.Fatal("Re-running an unreadable import succeeded")
+	}
+	txImport.Data = stored
+	e, err := mgr.Get(tximport.TXImport{}, txImport.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, imp := range []*tximport.TXImport{txImport, e.(*tximport.TXImport)} {
+		if imp.Status != tximport.Partial || imp.Total != 2 || imp.Good != 1 || imp.Bad != 1 || len(imp.ErrorLines()) != 1 {
+			t.Errorf("After a failed re-run: status %s, %d good, %d bad of %d, errors %q",
+				imp.Status, imp.Good, imp.Bad, imp.Total, imp.Errors)
+		}
+	}
+	if lineErrors, err = txImport.GetLineErrors(); err != nil || len(lineErrors) != 1 {
+		t.Errorf("%d line errors after a failed re-run, expected 1 (%v)", len(lineErrors), err)
+	}
+
+	counter := makeTestAccount(t, "Rerun Counter", 0)
+	counter.AccName = counterName
+	if err = mgr.Put(counter); err != nil {
+		t.Fatal(err)
+	}
+	if err = txImport.Rerun(); err != nil {
+		t.Fatal(err)
+	}
+	if txImport.Good != 2 || txImport.Bad != 0 || txImport.Total != 2 {
+		t.Errorf("After re-running: %d good, %d bad of %d", txImport.Good, txImport.Bad, txImport.Total)
+	}
+	if lineErrors, err = txImport.GetLineErrors(); err != nil || len(lineErrors) != 0 {
+		t.Errorf("Line errors left after re-running the fixed line: %d (%v)", len(lineErrors), err)
+	}
+	if msgs := txImport.ErrorLines(); len(msgs) != 0 {
+		t.Errorf("Import errors left after re-running the fixed line: %q", msgs)
+	}
+}
+
+func TestDateParser(t *testing.T) {
+	parser, err := tximport.MakeDateParser([]interface{}{"%d/%m/%Y", "%Y-%m-%d"}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, date := range []string{"02/01/2019", "02/01/19", "2019-01-02"} {
+		d, err := parser.Parse(date, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Year() != 2019 || d.Month() != 1 || d.Day() != 2 {
+			t.Errorf("Parsing %q gave %s", date, d)
+		}
+	}
+	d, err := parser.Parse("02/01/2019", "10:46:47", "EST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.UTC().Hour() != 15 {
+		t.Errorf("Expected 15:46:47 UTC, got %s", d.UTC())
+	}
+	if _, err = parser.Parse("01.02.2019", "", ""); err == nil {
+		t.Error("Expected error parsing 01.02.2019")
+	}
+}
+
+func TestAmountParser(t *testing.T) {
+	amounts := map[string]model.Money{
+		"1,234.56": 123456,
+		"$12.00":   1200,
+		"(45.00)":  -4500,
+		"45.00-":   -4500,
+		"-3.5 CAD": -350,
+	}
+	for s, expected := range amounts {
+		if amt, err := tximport.ParseAmount(s); err != nil || amt != expected {
+			t.Errorf("Parsing %q: expected %s, got %s (%v)", s, expected, amt, err)
+		}
+	}
+	european := tximport.MakeAmountParser(map[string]interface{}{"decimal": ",", "negate": true})
+	if amt, err := european.Parse("1.234,56 €"); err != nil || amt != -123456 {
+		t.Errorf("Parsing European amount: expected -1234.56, got %s (%v)", amt, err)
+	}
+	if _, err := tximport.ParseAmount("abc"); err == nil {
+		t.Error("Expected error parsing abc")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	imp := &tximport.CSVImporter{Config: map[string]interface{}{"match": "contact"}}
+	for _, def := range []map[string]interface{}{
+		{"template": "CANADIAN TIRE GAS BAR", "matchon": "description", "category": "Gas"},
+		{"template": "canadian tire", "matchon": "description", "ignorecase": true, "category": "Maintenance", "project": "Kitchener"},
+		{"conditions": map[string]interface{}{"description": "^AMAZON", "memo": "Prime"}, "category": "Subscriptions", "stop": true},
+		{"template": "Amazon", "minamt": "100", "sign": "debit", "category": "Electronics"},
+		{"template": "Amazon", "category": "Books", "contact": "Amazon"},
+	} {
+		tmpl, err := tximport.MakeTemplate(def)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imp.Templates = append(imp.Templates, tmpl)
+	}
+	for _, c := range []struct {
+		fields   map[string]string
+		amt      model.Money
+		category string
+		project  string
+	}{
+		{map[string]string{"description": "CANADIAN TIRE GAS BAR #12"}, -4000, "Gas", "Kitchener"},
+		{map[string]string{"description": "Canadian Tire #3"}, -4000, "Maintenance", "Kitchener"},
+		{map[string]string{"description": "AMAZON.CA", "memo": "Prime renewal", "contact": "Amazon"}, -799, "Subscriptions", ""},
+		{map[string]string{"description": "AMAZON.CA", "memo": "Order", "contact": "Amazon"}, -25000, "Electronics", ""},
+		{map[string]string{"description": "AMAZON.CA", "memo": "Order", "contact": "Amazon"}, 25000, "Books", ""},
+		{map[string]string{"description": "AMAZON.CA", "memo": "Order", "contact": "Amazon"}, -2500, "Books", ""},
+	} {
+		imp.ApplyTemplates(c.fields, c.amt)
+		if c.fields["category"] != c.category || c.fields["project"] != c.project {
+			t.Errorf("%q (%s) categorized as %q/%q, expected %q/%q", c.fields["description"], c.amt,
+				c.fields["category"], c.fields["project"], c.category, c.project)
+		}
+	}
+	if _, err := tximport.MakeTemplate(map[string]interface{}{"template": "X", "sign": "both"}); err == nil {
+		t.Errorf("Template with invalid sign accepted")
+	}
+}
+
+func TestSuggestTemplate(t *testing.T) {
+	for description, expected := range map[string]string{
+		"POS MEC 1234 WATERLOO":  "^POS MEC",
+		"STARBUCKS COFFEE #4471": "^STARBUCKS COFFEE",
+		"A&W":                    "^A&W",
+		"INS SUN LIFE (LTD)":     "^INS SUN LIFE \\(LTD\\)",
+	} {
+		if template := tximport.SuggestTemplate(description); template != expected {
+			t.Errorf("Template for %q is %q, expected %q", description, template, expected)
+		}
+		tmpl, err := tximport.MakeTemplate(map[string]interface{}{"template": tximport.SuggestTemplate(description)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		imp := &tximport.CSVImporter{Templates: []tximport.Template{tmpl}}
+		fields := map[string]string{"description": description}
+		imp.ApplyTemplates(fields, 0)
+		if fields["template"] == "" {
+			t.Errorf("Suggested template for %q does not match it", description)
+		}
+	}
+}
+
+func TestMoney(t *testing.T) {
+	var sum model.Money
+	for i := 0; i < 10000; i++ {
+		m, err := model.ParseMoney("0.10")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum += m
+	}
+	if sum.String() != "1000.00" {
+		t.Errorf("Expected 1000.00, got %s", sum)
+	}
+	if m, err := model.ParseMoney("-12.345"); err != nil || m != -1235 {
+		t.Errorf("Expected -12.35, got %s (%v)", m, err)
+	}
+	b, err := json.Marshal(model.Money(-5))
+	if err != nil || string(b) != `"-0.05"` {
+		t.Errorf("Expected \"-0.05\", got %s (%v)", b, err)
+	}
+	var m model.Money
+	if err = json.Unmarshal([]byte("12.5"), &m); err != nil || m != 1250 {
+		t.Errorf("Expected 12.50, got %s (%v)", m, err)
+	}
+	if s := fmt.Sprintf("%9.2f", model.Money(123456)); s != "  1234.56" {
+		t.Errorf("Expected \"  1234.56\", got %q", s)
+	}
+	v, err := model.Money(1200).Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []interface{}{v, []byte("12"), int64(12), float64(12)} {
+		if err = m.Scan(src); err != nil || m != 1200 {
+			t.Errorf("Scanning %v (%T): expected 12.00, got %s (%v)", src, src, m, err)
+		}
+	}
+}
+
+func TestMoneyColumns(t *testing.T) {
+	err := mgr.TX(func(db *sql.DB) (err error) {
+		rows, err := db.Query("SELECT data_type FROM information_schema.columns WHERE column_name = 'Amt'")
+		if err != nil {
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var dataType string
+			if err = rows.Scan(&dataType); err != nil {
+				return
+			}
+			if dataType != "numeric" {
+				t.Errorf("Amt column has type %s, expected numeric", dataType)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acc := makeTestAccount(t, "Money Columns", 0)
+	amts := []string{"0.10", "0.20", "-0.05", "1234567.89"}
+	var sum model.Money
+	for _, s := range amts {
+		amt, err := model.ParseMoney(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := addTestTransaction(t, acc, time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC), amt, s)
+		e, err := mgr.Get(model.Transaction{}, tx.Id())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored := model.TransactionOf(e); stored == nil || stored.Amt != amt {
+			t.Errorf("Stored %s, read back %v", amt, stored)
+		}
+		sum += amt
+	}
+	acc, err = model.GetAccount(mgr, acc.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.CurrentBalance != sum || acc.CurrentBalance.String() != "1234568.14" {
+		t.Errorf("Balance is %s, expected %s", acc.CurrentBalance, sum)
+	}
+}
+
+func TestExchangeRates(t *testing.T) {
+	err := mgr.TX(func(db *sql.DB) (err error) {
+		if _, err = model.LoadExchangeRates(mgr, "data/exchangerates.csv"); err != nil {
+			return
+		}
+		date := time.Date(2019, 2, 15, 0, 0, 0, 0, time.UTC)
+		rate, err := model.GetExchangeRate(mgr, "USD", "CAD", date)
+		if err != nil {
+			return
+		}
+		if rate != 1.3104 {
+			t.Errorf("Expected USD/CAD rate 1.3104, got %f", rate)
+		}
+		amt, err := model.ConvertMoney(mgr, 10000, "CAD", "USD", date)
+		if err != nil {
+			return
+		}
+		if amt != 7631 {
+			t.Errorf("Expected 100.00 CAD to be 76.31 USD, got %s", amt)
+		}
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONReportingBalances(t *testing.T) {
+	acc := makeTestAccount(t, "Reporting", 10000)
+	acc.Currency = "XTS"
+	if err := mgr.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.SetExchangeRate(mgr, time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), "XTS", "CAD", 1.5); err != nil {
+		t.Fatal(err)
+	}
+	for currency, expected := range map[string]string{"": "0.00", "cad": "150.00"} {
+		w := httptest.NewRecorder()
+		path := fmt.Sprintf("/json/account?institutionid=%d&currency=%s", acc.Parent().Id(), currency)
+		handler.JSON(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s returned status %d", path, w.Code)
+		}
+		var results [][]map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("GET %s returned %d accounts, expected 1", path, len(results))
+		}
+		account := results[0][0]
+		if account["ReportingBalance"] != expected || account["ReportingCurrency"] != strings.ToUpper(currency) {
+			t.Errorf("GET %s returned reporting balance %v %v, expected %s %s", path,
+				account["ReportingBalance"], account["ReportingCurrency"], expected, strings.ToUpper(currency))
+		}
+	}
+}
+
+func TestLatestExchangeRate(t *testing.T) {
+	// A rate from long before the date is found, but a more recent one wins.
+	from, to := "XTS", fmt.Sprintf("X%02d", time.Now().UnixNano()%100)
+	date := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	if err := model.SetExchangeRate(mgr, date.AddDate(-1, 0, 0), from, to, 2); err != nil {
+		t.Fatal(err)
+	}
+	if rate, err := model.GetExchangeRate(mgr, from, to, date); err != nil || rate != 2 {
+		t.Errorf("Rate from a year before is %f (%v), expected 2", rate, err)
+	}
+	if err := model.SetExchangeRate(mgr, date.AddDate(0, 0, -3), from, to, 4); err != nil {
+		t.Fatal(err)
+	}
+	if rate, err := model.GetExchangeRate(mgr, from, to, date); err != nil || rate != 4 {
+		t.Errorf("Rate from three days before is %f (%v), expected 4", rate, err)
+	}
+	if rate, err := model.GetExchangeRate(mgr, to, from, date); err != nil || rate != 0.25 {
+		t.Errorf("Inverse rate is %f (%v), expected 0.25", rate, err)
+	}
+}
+
+func TestDataFile(t *testing.T) {
+	for name, expected := range map[string]string{
+		"exchangerates.csv":          filepath.Join("data", "exchangerates.csv"),
+		"rates/../exchangerates.csv": filepath.Join("data", "exchangerates.csv"),
+		"../finn_test.go":            "",
+		"/etc/passwd":                "",
+	} {
+		fileName, err := dataFile(name)
+		if expected == "" && err == nil {
+			t.Errorf("%q outside the data directory accepted as %q", name, fileName)
+		}
+		if expected != "" && (err != nil || fileName != expected) {
+			t.Errorf("%q is %q (%v), expected %q", name, fileName, err, expected)
+		}
+	}
+}
+
+func TestCategoryBalances(t *testing.T) {
+	q := mgr.MakeQuery(&model.Category{})
+	q = (&model.Category{}).ManyQuery(q, url.Values{"from": {"2019-01-01"}, "to": {"2019-12-31"}})
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	own := make(map[int]model.Money)
+	for _, row := range results {
+		own[row[0].Id()] = row[0].(*model.Category).CurrentBalance
+	}
+	model.RollUpBalances(results)
+	expected := make(map[int]model.Money)
+	for id, balance := range own {
+		expected[id] += balance
+	}
+	for _, row := range results {
+		category := row[0].(*model.Category)
+		if parent := category.Parent(); parent != nil {
+			if _, ok := own[parent.Id()]; ok {
+				expected[parent.Id()] += category.CurrentBalance
+			}
+		}
+	}
+	for _, row := range results {
+		category := row[0].(*model.Category)
+		if category.CurrentBalance != expected[category.Id()] {
+			t.Errorf("Balance of %q is %s, expected %s", category.Name, category.CurrentBalance, expected[category.Id()])
+		}
+	}
+}
+
+// makeTestAccount creates an account with the given opening balance on
+// 2019-01-01. A timestamp is appended to the name, so that tests can be run
+// more than once against the same database.
+func makeTestAccount(t *testing.T, name string, opening model.Money) *model.Account {
+	inst := &model.Institution{Name: "Test Bank"}
+	inst.SetManager(mgr)
+	if err := mgr.Put(inst); err != nil {
+		t.Fatal(err)
+	}
+	acc := &model.Account{}
+	acc.Initialize(inst, 0)
+	acc.AccName = fmt.Sprintf("%s %d", name, time.Now().UnixNano())
+	acc.Currency = "CAD"
+	if err := mgr.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.SetOpeningBalance(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), opening); err != nil {
+		t.Fatal(err)
+	}
+	return acc
+}
+
+// addTestTransaction books a debit or credit, depending on the sign of amt.
+func addTestTransaction(t *testing.T, acc *model.Account, date time.Time, amt model.Money, description string) *model.Transaction {
+	txType := model.Credit
+	if amt < 0 {
+		txType = model.Debit
+	}
+	e, err := acc.MakeTransaction(txType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := e.(*model.Transaction)
+	tx.Date = date
+	tx.Amt = amt
+	tx.Description = description
+	if err = mgr.Put(tx); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestStatementPeriod(t *testing.T) {
+	acc := makeTestAccount(t, "Statement Period", model.MoneyFromFloat(100))
+	addTestTransaction(t, acc, time.Date(2019, 1, 15, 0, 0, 0, 0, time.UTC), model.MoneyFromFloat(-10), "Before")
+	addTestTransaction(t, acc, time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC), model.MoneyFromFloat(50), "First day")
+	addTestTransaction(t, acc, time.Date(2019, 2, 10, 0, 0, 0, 0, time.UTC), model.MoneyFromFloat(-20), "During")
+	addTestTransaction(t, acc, time.Date(2019, 2, 28, 18, 30, 0, 0, time.UTC), model.MoneyFromFloat(-5), "Last day, afternoon")
+	addTestTransaction(t, acc, time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC), model.MoneyFromFloat(1000), "After")
+
+	q := mgr.MakeQuery(&model.Account{})
+	q.AddQueryCondition(grumble.HasId{Id: acc.Id()})
+	q = (&model.Account{}).ManyQuery(q, url.Values{"from": {"2019-02-01"}, "to": {"2019-02-28"}})
+	results, err := q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 account, got %d", len(results))
+	}
+	period := results[0][0].(*model.Account)
+	for _, check := range []struct {
+		name     string
+		actual   model.Money
+		expected float64
+	}{
+		{"opening balance", period.OpeningBalance, 90},
+		{"credits", period.TotalCredit, 50},
+		{"debits", period.TotalDebit, 25},
+		{"closing balance", period.CurrentBalance, 115},
+	} {
+		if check.actual != model.MoneyFromFloat(check.expected) {
+			t.Errorf("Statement period %s is %s, expected %.2f", check.name, check.actual, check.expected)
+		}
+	}
+}
+
+func TestTransactionPaging(t *testing.T) {
+	txs := make([]*model.Transaction, 5)
+	results := make([][]grumble.Persistable, len(txs))
+	for ix := range txs {
+		txs[ix] = &model.Transaction{Description: fmt.Sprintf("tx%d", ix)}
+		results[ix] = []grumble.Persistable{txs[ix]}
+	}
+	page, err := (&model.Transaction{}).ProcessResults(results, url.Values{"sort": {"-date"}, "page": {"2"}, "pagesize": {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0][0] != txs[2] || page[1][0] != txs[1] {
+		t.Errorf("Expected tx2 and tx1 on page 2")
+	}
+	if _, err = (&model.Transaction{}).ProcessResults(results, url.Values{"page": {"0"}}); err == nil {
+		t.Error("Expected error for page 0")
+	}
+	acc := makeTestAccount(t, "Paging", 0)
+	path := fmt.Sprintf("/json/transaction?accountid=%d&description=nomatch&page=0", acc.Id())
+	if status := jsonRequest(http.MethodGet, path, ""); status != http.StatusBadRequest {
+		t.Errorf("GET with page 0 and no results returned status %d, expected %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestTransactionSearch(t *testing.T) {
+	acc := makeTestAccount(t, "Search", 0)
+	suffix := time.Now().UnixNano()
+	food := &model.Category{Name: fmt.Sprintf("Food %d", suffix)}
+	food.SetManager(mgr)
+	if err := mgr.Put(food); err != nil {
+		t.Fatal(err)
+	}
+	groceries := &model.Category{Name: fmt.Sprintf("Groceries %d", suffix)}
+	groceries.Initialize(food, 0)
+	project := &model.Project{Name: fmt.Sprintf("Kitchen %d", suffix)}
+	project.SetManager(mgr)
+	contact := &model.Contact{Name: fmt.Sprintf("Chez Nous %d", suffix)}
+	contact.SetManager(mgr)
+	for _, e := range []grumble.Persistable{groceries, project, contact} {
+		if err := mgr.Put(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	date := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	loblaws := addTestTransaction(t, acc, date, -5000, "Loblaws 123")
+	loblaws.Category, loblaws.Project = groceries, project
+	restaurant := addTestTransaction(t, acc, date, -3000, "Restaurant Chez Nous")
+	restaurant.Category, restaurant.Contact = food, contact
+	addTestTransaction(t, acc, date, 100000, "Salary")
+	coffee := addTestTransaction(t, acc, date, -500, "Coffee shop")
+	coffee.Consolidated = true
+	for _, tx := range []*model.Transaction{loblaws, restaurant, coffee} {
+		if err := mgr.Put(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, check := range []struct {
+		query    string
+		expected []string
+	}{
+		{"description=loblaws", []string{"Loblaws 123"}},
+		{"regex=" + url.QueryEscape("^(salary|coffee)"), []string{"Salary", "Coffee shop"}},
+		{"minamt=-40&maxamt=-1", []string{"Restaurant Chez Nous", "Coffee shop"}},
+		{fmt.Sprintf("categoryid=%d", food.Id()), []string{"Loblaws 123", "Restaurant Chez Nous"}},
+		{fmt.Sprintf("categoryid=%d", groceries.Id()), []string{"Loblaws 123"}},
+		{fmt.Sprintf("projectid=%d", project.Id()), []string{"Loblaws 123"}},
+		{fmt.Sprintf("contactid=%d", contact.Id()), []string{"Restaurant Chez Nous"}},
+		{"type=C", []string{"Salary"}},
+		{"type=" + url.QueryEscape("D, C"), []string{"Loblaws 123", "Restaurant Chez Nous", "Salary", "Coffee shop"}},
+		{"consolidated=true", []string{"Coffee shop"}},
+		{"uncategorized=true&consolidated=false", []string{"Salary"}},
+	} {
+		w := httptest.NewRecorder()
+		path := fmt.Sprintf("/json/transaction?accountid=%d&%s", acc.Id(), check.query)
+		handler.JSON(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s returned status %d", path, w.Code)
+			continue
+		}
+		var results [][]map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		// The opening balance of the account is not part of the checks.
+		found := make(map[string]bool)
+		count := 0
+		for _, row := range results {
+			if row[0]["TXType"] != model.OpeningBalance {
+				found[fmt.Sprint(row[0]["Description"])] = true
+				count++
+			}
+		}
+		ok := len(found) == len(check.expected) && count == len(check.expected)
+		for _, description := range check.expected {
+			ok = ok && found[description]
+		}
+		if !ok {
+			t.Errorf("GET %s returned %v, expected %v", path, found, check.expected)
+		}
+	}
+	for _, query := range []string{"regex=" + url.QueryEscape("(unclosed"), "type=X", "minamt=lots", "consolidated=maybe"} {
+		path := fmt.Sprintf("/json/transaction?accountid=%d&%s", acc.Id(), query)
+		if status := jsonRequest(http.MethodGet, path, ""); status != http.StatusBadRequest {
+			t.Errorf("GET %s returned status %d, expected %d", path, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestRunningBalance(t *testing.T) {
+	acc, err := model.GetAccountByName(mgr, "ManulifeOne")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs, err := acc.GetTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var balance model.Money
+	for _, tx := range txs {
+		balance += tx.Amt
+		if tx.Balance != balance {
+			t.Fatalf("Balance after %q on %s is %s, expected %s",
+				tx.Description, tx.Date.Format("2006-01-02"), tx.Balance, balance)
+		}
+	}
+}
+
+func TestRecategorize(t *testing.T) {
+	acc, err := model.GetAccountByName(mgr, "ManulifeOne")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recat, err := tximport.MakeRecategorization(acc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = recat.Propose(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range recat.Transactions {
+		for _, change := range tx.Changes {
+			if change.Old != "" {
+				t.Errorf("%q: %s %q would be overwritten by %q", tx.Description, change.Field, change.Old, change.New)
+			}
+		}
+	}
+	if _, err = recat.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if err = recat.Propose(); err != nil {
+		t.Fatal(err)
+	}
+	if len(recat.Transactions) > 0 {
+		t.Errorf("%d transactions still change after recategorizing", len(recat.Transactions))
+	}
+}
+
+func TestRecategorizeImportFields(t *testing.T) {
+	acc := csvTestAccount(t, "Recategorize CSV", "")
+	if txImport := importData(t, acc, "CSV", csvMemoData); txImport.Good != 2 {
+		t.Fatalf("Expected 2 imported transactions, got %d: %s", txImport.Good, txImport.Errors)
+	}
+	addTestTransaction(t, acc, time.Date(2019, 3, 3, 0, 0, 0, 0, time.UTC), -500, "AMAZON MKTPLACE")
+	template := map[string]interface{}{"name": "Prime", "conditions": map[string]interface{}{"memo": "Prime"}, "category": "Subscriptions"}
+	if _, err := tximport.AddTemplate(acc, template); err != nil {
+		t.Fatal(err)
+	}
+	recat, err := tximport.MakeRecategorization(acc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = recat.Propose(); err != nil {
+		t.Fatal(err)
+	}
+	if len(recat.Transactions) != 1 {
+		t.Fatalf("%d transactions recategorized, expected 1", len(recat.Transactions))
+	}
+	changes := recat.Transactions[0]
+	if changes.Amt != -799 || len(changes.Changes) != 1 || changes.Changes[0].New != "Subscriptions" {
+		t.Errorf("Expected the Prime renewal to be categorized as Subscriptions: %+v", changes)
+	}
+	if len(recat.Unchecked) != 1 || recat.Unchecked[0] != "Prime" {
+		t.Errorf("Templates not checked against all transactions: %q, expected Prime", recat.Unchecked)
+	}
+}
+
+func TestCoverageReport(t *testing.T) {
+	acc := makeTestAccount(t, "Coverage", 0)
+	for _, def := range []map[string]interface{}{
+		{"name": "Gas", "template": "^PETRO", "category": "Gas"},
+		{"name": "Coffee", "template": "^STARBUCKS", "category": "Coffee", "stop": true},
+		{"name": "Snacks", "template": "^STARBUCKS", "project": "Snacks"},
+		{"name": "Fuel", "template": "^PETRO-CANADA", "category": "Fuel"},
+		{"name": "Doughnuts", "template": "^TIM HORTONS", "category": "Food"},
+		{"name": "Parking", "template": "^IMPARK", "category": "Parking"},
+	} {
+		if _, err := tximport.AddTemplate(acc, def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	date := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, description := range []string{
+		"PETRO-CANADA 1234", "PETRO-CANADA 5678", "STARBUCKS COFFEE #44", "TIM HORTONS #12",
+		"NETFLIX.COM", "NETFLIX.COM", "SHOPPERS DRUG MART 0812",
+	} {
+		addTestTransaction(t, acc, date, -1000, description)
+	}
+	report, err := tximport.MakeCoverageReport(acc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Lines != 7 || report.Matched != 4 {
+		t.Errorf("%d of %d transactions matched, expected 4 of 7", report.Matched, report.Lines)
+	}
+	if len(report.Unmatched) != 2 {
+		t.Fatalf("%d unmatched groups, expected 2", len(report.Unmatched))
+	}
+	for ix, expected := range []struct {
+		key        string
+		count      int
+		suggestion string
+	}{
+		{"NETFLIX.COM", 2, "^NETFLIX\\.COM"},
+		{"SHOPPERS DRUG MART", 1, "^SHOPPERS DRUG MART"},
+	} {
+		group := report.Unmatched[ix]
+		if group.Key != expected.key || group.Count != expected.count || group.Suggestion != expected.suggestion {
+			t.Errorf("Unmatched group %d is %q (%d, %q), expected %q (%d, %q)", ix,
+				group.Key, group.Count, group.Suggestion, expected.key, expected.count, expected.suggestion)
+		}
+	}
+	if len(report.Unmatched[0].Descriptions) != 1 {
+		t.Errorf("Unmatched group %q lists %d descriptions, expected 1", report.Unmatched[0].Key, len(report.Unmatched[0].Descriptions))
+	}
+	if unused := report.Unused(); len(unused) != 1 || unused[0].Template != "Parking" {
+		t.Errorf("Expected only Parking to be unused")
+	}
+	shadowed := make(map[string]string)
+	for _, coverage := range report.Shadowed() {
+		shadowed[coverage.Template] = coverage.ShadowedBy
+	}
+	if len(shadowed) != 2 || shadowed["Fuel"] != "Gas" || shadowed["Snacks"] != "Coffee" {
+		t.Errorf("Shadowed templates are %v, expected Fuel by Gas and Snacks by Coffee", shadowed)
+	}
+	for _, coverage := range report.Templates {
+		if coverage.Template == "Snacks" && coverage.Matches != 1 {
+			t.Errorf("Snacks matched %d transactions, expected 1", coverage.Matches)
+		}
+	}
+}
+
+// csvTestAccount creates an account with a CSV import profile mapping the
+// columns date, description, amount and memo, and the given templates.
+func csvTestAccount(t *testing.T, name string, templates string) *model.Account {
+	acc := makeTestAccount(t, name, 0)
+	acc.Importer = "CSV"
+	if err := mgr.Put(acc); err != nil {
+		t.Fatal(err)
+	}
+	profile := &tximport.ImportProfile{
+		Mapping:   `[{"name": "date", "type": "date", "format": "%Y-%m-%d"}, "description", {"name": "amt", "type": "money"}, "memo"]`,
+		Templates: tximport.JSONText(templates),
+	}
+	profile.Initialize(acc, 0)
+	if err := mgr.Put(profile); err != nil {
+		t.Fatal(err)
+	}
+	return acc
+}
+
+const csvMemoData = `2019-03-01,AMAZON.CA,-7.99,Prime renewal
+2019-03-02,AMAZON.CA,-25.00,Order
+`
+
+func TestCoverageImportFields(t *testing.T) {
+	acc := csvTestAccount(t, "Coverage CSV", `[
+		{"name": "Prime", "conditions": {"memo": "Prime"}, "category": "Subscriptions"},
+		{"name": "Amazon", "template": "^AMAZON", "category": "Shopping"}
+	]`)
+	txImport := importData(t, acc, "CSV", csvMemoData)
+	if txImport.Good != 2 {
+		t.Fatalf("Expected 2 imported transactions, got %d: %s", txImport.Good, txImport.Errors)
+	}
+	addTestTransaction(t, acc, time.Date(2019, 3, 3, 0, 0, 0, 0, time.UTC), -500, "AMAZON MKTPLACE")
+
+	for _, check := range []struct {
+		txImport *tximport.TXImport
+		lines    int
+		untested int
+	}{
+		{nil, 3, 1},
+		{txImport, 2, 0},
+	} {
+		report, err := tximport.MakeCoverageReport(acc, check.txImport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Lines != check.lines || report.Matched != check.lines {
+			t.Errorf("%d of %d transactions matched, expected all of %d", report.Matched, report.Lines, check.lines)
+		}
+		coverage := make(map[string]*tximport.TemplateCoverage)
+		for _, c := range report.Templates {
+			coverage[c.Template] = c
+		}
+		if prime := coverage["Prime"]; prime == nil || prime.Matches != 1 || prime.Hits != 1 || prime.Untested != check.untested {
+			t.Errorf("Template on the memo column: %+v, expected 1 match and %d transactions not checked", prime, check.untested)
+		}
+		if len(report.Unused()) != 0 {
+			t.Errorf("Templates reported as unused: %d", len(report.Unused()))
+		}
+		if unchecked := report.Unchecked(); len(unchecked) != check.untested || (len(unchecked) == 1 && unchecked[0].Template != "Prime") {
+			t.Errorf("%d templates reported as not checked, expected %d", len(unchecked), check.untested)
+		}
+	}
+}
+
+func TestReconciliation(t *testing.T) {
+	acc, err := model.GetAccountByName(mgr, "ManulifeOne")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs, err := acc.GetTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) == 0 {
+		t.Fatal("No transactions to reconcile")
+	}
+	first := txs[0]
+	rec, err := acc.StartReconciliation(first.Date, first.Amt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rec.Clear(first.Id(), true); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Difference != 0 {
+		t.Fatalf("Difference after clearing %q is %s, expected 0", first.Description, rec.Difference)
+	}
+	if err = rec.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = acc.StartReconciliation(first.Date, 0); err != nil {
+		t.Fatal(err)
+	}
+	rec, err = acc.OpenReconciliation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rec.Clear(first.Id(), false); err != model.ErrLocked {
+		t.Errorf("Unclearing a reconciled transaction returned %v, expected %v", err, model.ErrLocked)
+	}
+}
+
+func TestReconciliationStatementDay(t *testing.T) {
+	acc := makeTestAccount(t, "Reconciliation", 0)
+	during := addTestTransaction(t, acc, time.Date(2019, 2, 10, 0, 0, 0, 0, time.UTC), model.MoneyFromFloat(50), "During")
+	lastDay := addTestTransaction(t, acc, time.Date(2019, 2, 28, 18, 30, 0, 0, time.UTC), model.MoneyFromFloat(-5), "Last day, afternoon")
+	after := addTestTransaction(t, acc, time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC), model.MoneyFromFloat(10), "After")
+
+	rec, err := acc.StartReconciliation(time.Date(2019, 2, 28, 0, 0, 0, 0, time.UTC), model.MoneyFromFloat(45))
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs, err := rec.Transactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[int]bool)
+	for _, tx := range txs {
+		listed[tx.Id()] = true
+	}
+	if !listed[lastDay.Id()] || listed[after.Id()] {
+		t.Errorf("Reconciliation should list the transaction on the statement day and not the one after it")
+	}
+	for _, tx := range []*model.Transaction{during, lastDay} {
+		if err = rec.Clear(tx.Id(), true); err != nil {
+			t.Fatalf("Clearing %q: %s", tx.Description, err)
+		}
+	}
+	if err = rec.Clear(after.Id(), true); err == nil {
+		t.Errorf("Clearing a transaction after the statement date succeeded")
+	}
+	if rec.Difference != 0 {
+		t.Fatalf("Difference is %s, expected 0", rec.Difference)
+	}
+	if err = rec.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	e, err := mgr.Get(model.Transaction{}, lastDay.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = model.CheckUnlocked(e); err != model.ErrLocked {
+		t.Errorf("Transaction on the statement day was not locked")
+	}
+}
+
+// jsonRequest serves a request through the JSON API and returns the
+// response status.
+func jsonRequest(method string, path string, body string) int {
+	w := httptest.NewRecorder()
+	var r *http.Request
+	if body != "" {
+		r = httptest.NewRequest(method, path, strings.NewReader(body))
+	} else {
+		r = httptest.NewRequest(method, path, nil)
+	}
+	handler.JSON(w, r)
+	return w.Code
+}
+
+func TestJSONMethods(t *testing.T) {
+	if status := jsonRequest(http.MethodOptions, "/json/transaction", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("OPTIONS returned status %d, expected %d", status, http.StatusMethodNotAllowed)
+	}
+	acc := makeTestAccount(t, "JSON", 0)
+	path := fmt.Sprintf("/json/transaction?parentkind=account&parentid=%d", acc.Id())
+	for _, check := range []struct {
+		body   string
+		status int
+	}{
+		{`{"TXType": "D", "Amt": "-12.34", "Description": "No date"}`, http.StatusBadRequest},
+		{`{"Date": "2019-01-02T00:00:00Z", "TXType": "X", "Amt": "-12.34"}`, http.StatusBadRequest},
+		{`{"Date": "2019-01-02T00:00:00Z", "TXType": "D", "Amt": "-12.34", "ImportId": 3}`, http.StatusBadRequest},
+		{`{"Date": "2019-01-02T00:00:00Z", "TXType": "D", "Amt": "-12.34", "Description": "Created"}`, http.StatusCreated},
+	} {
+		if status := jsonRequest(http.MethodPost, path, check.body); status != check.status {
+			t.Errorf("POST %s returned status %d, expected %d", check.body, status, check.status)
+		}
+	}
+	txs, err := acc.GetTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created *model.Transaction
+	for _, tx := range txs {
+		if tx.Description == "Created" {
+			created = tx
+		}
+	}
+	if created == nil || created.Amt != -1234 {
+		t.Fatalf("POST did not create the transaction")
+	}
+
+	path = fmt.Sprintf("/json/transaction/%d", created.Id())
+	for _, check := range []struct {
+		body   string
+		status int
+	}{
+		{`{"Description": "Updated"}`, http.StatusOK},
+		{`{"Date": "0001-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{`{"ReconciliationId": 5}`, http.StatusBadRequest},
+		{`{"Consolidated": true}`, http.StatusBadRequest},
+	} {
+		if status := jsonRequest(http.MethodPatch, path, check.body); status != check.status {
+			t.Errorf("PATCH %s returned status %d, expected %d", check.body, status, check.status)
+		}
+	}
+	e, err := mgr.Get(model.Transaction{}, created.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx := model.TransactionOf(e); tx == nil || tx.Description != "Updated" || tx.Amt != -1234 || tx.Locked() {
+		t.Errorf("PATCH did not update only the description: %v", e)
+	}
+
+	locked := addTestTransaction(t, acc, time.Date(2019, 1, 3, 0, 0, 0, 0, time.UTC), -100, "Locked")
+	locked.ReconciliationId = 1
+	if err = mgr.Put(locked); err != nil {
+		t.Fatal(err)
+	}
+	if status := jsonRequest(http.MethodDelete, fmt.Sprintf("/json/transaction/%d", locked.Id()), ""); status != http.StatusConflict {
+		t.Errorf("Deleting a locked transaction returned status %d, expected %d", status, http.StatusConflict)
+	}
+	if status := jsonRequest(http.MethodDelete, path, ""); status != http.StatusNoContent {
+		t.Errorf("DELETE returned status %d, expected %d", status, http.StatusNoContent)
+	}
+	if e, err = mgr.Get(model.Transaction{}, created.Id()); err != nil || (e != nil && model.TransactionOf(e) != nil) {
+		t.Errorf("Transaction still exists after DELETE")
+	}
+}
+
+func TestLearnFromUpdate(t *testing.T) {
+	acc := makeTestAccount(t, "Learn", 0)
+	cat := &model.Category{Name: fmt.Sprintf("Books %d", time.Now().UnixNano())}
+	cat.SetManager(mgr)
+	if err := mgr.Put(cat); err != nil {
+		t.Fatal(err)
+	}
+	edited := addTestTransaction(t, acc, time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC), -2500, "INDIGO BOOKS 0421")
+	addTestTransaction(t, acc, time.Date(2019, 2, 8, 0, 0, 0, 0, time.UTC), -1800, "INDIGO BOOKS 0877")
+
+	catJSON, err := json.Marshal(cat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"Category": %s}`, catJSON)
+	if status := jsonRequest(http.MethodPatch, fmt.Sprintf("/json/transaction/%d", edited.Id()), body); status != http.StatusOK {
+		t.Fatalf("PATCH returned status %d", status)
+	}
+	suggestions, err := tximport.GetRuleSuggestions(acc, tximport.SuggestionOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suggestions) != 1 {
+		t.Fatalf("%d rule suggestions after changing the category, expected 1", len(suggestions))
+	}
+	suggestion := suggestions[0]
+	if suggestion.Template != "^INDIGO BOOKS" || suggestion.Category != cat.Name || suggestion.TxId != edited.Id() {
+		t.Errorf("Suggested %q for %q from transaction %d", suggestion.Template, suggestion.Category, suggestion.TxId)
+	}
+
+	count, err := suggestion.Accept(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Accepting the suggestion recategorized %d transactions, expected 1", count)
+	}
+	if suggestions, err = tximport.GetRuleSuggestions(acc, tximport.SuggestionAccepted); err != nil {
+		t.Fatal(err)
+	}
+	if len(suggestions) != 1 {
+		t.Errorf("%d accepted rule suggestions, expected 1", len(suggestions))
+	}
+	profile, err := tximport.GetImportProfile(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile == nil {
+		t.Fatal("Accepting the suggestion did not create an import profile")
+	}
+	data, err := profile.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, _ := data["templates"].([]interface{})
+	found := false
+	for _, def := range templates {
+		if tmpl, ok := def.(map[string]interface{}); ok && tmpl["template"] == "^INDIGO BOOKS" && tmpl["category"] == cat.Name {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Suggested template not added to the profile: %v", templates)
+	}
+}
+
+func TestJSONTransfers(t *testing.T) {
+	acc := makeTestAccount(t, "JSON Transfer", 0)
+	counter := makeTestAccount(t, "JSON Transfer Counter", 0)
+	e, err := acc.MakeTransaction(model.Transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := e.(*model.TransferTx)
+	transfer.Date = time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC)
+	transfer.Amt = model.MoneyFromFloat(-10)
+	transfer.Description = "Transfer"
+	if err = acc.Transfer(transfer, counter); err != nil {
+		t.Fatal(err)
+	}
+	crossId := transfer.CrossPost.Id()
+	kind := grumble.GetKind(&model.TransferTx{}).Kind
+	path := fmt.Sprintf("/json/%s/%d", kind, transfer.Id())
+
+	if status := jsonRequest(http.MethodPatch, path, `{"Amt": "-20.00", "Description": "Changed"}`); status != http.StatusOK {
+		t.Fatalf("PATCH returned status %d", status)
+	}
+	if e, err = mgr.Get(model.TransferTx{}, crossId); err != nil {
+		t.Fatal(err)
+	}
+	if cross, ok := e.(*model.TransferTx); !ok || cross.Amt != model.MoneyFromFloat(20) || cross.Description != "Changed" {
+		t.Errorf("PATCH of a transfer did not update the other side: %v", e)
+	}
+
+	if status := jsonRequest(http.MethodDelete, path, ""); status != http.StatusNoContent {
+		t.Fatalf("DELETE returned status %d", status)
+	}
+	txs, err := counter.GetTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := 0
+	for _, tx := range txs {
+		switch tx.TXType {
+		case model.Transfer:
+			t.Errorf("Transfer %q in the counter account was not reverted", tx.Description)
+		case model.Credit:
+			if tx.Amt == model.MoneyFromFloat(20) {
+				plain++
+			}
+		}
+	}
+	if plain != 1 {
+		t.Errorf("Expected the other side of the deleted transfer as a plain credit")
+	}
+}
+
+func TestJSONCreateTransfer(t *testing.T) {
+	acc := makeTestAccount(t, "JSON New Transfer", 0)
+	counter := makeTestAccount(t, "JSON New Transfer Counter", 0)
+	counterJSON, err := json.Marshal(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kind := grumble.GetKind(&model.TransferTx{}).Kind
+	path := fmt.Sprintf("/json/%s?parentkind=account&parentid=%d", kind, acc.Id())
+	if status := jsonRequest(http.MethodPost, path, `{"Date": "2019-01-02T00:00:00Z", "Amt": "-15.00"}`); status != http.StatusBadRequest {
+		t.Errorf("POST of a transfer without counter account returned status %d, expected %d", status, http.StatusBadRequest)
+	}
+	body := fmt.Sprintf(`{"Date": "2019-01-02T00:00:00Z", "Amt": "-15.00", "Description": "New transfer", "Account": %s}`, counterJSON)
+	if status := jsonRequest(http.MethodPost, path, body); status != http.StatusCreated {
+		t.Fatalf("POST of a transfer returned status %d", status)
+	}
+	for _, check := range []struct {
+		account *model.Account
+		amt     model.Money
+		other   *model.Account
+	}{
+		{acc, model.MoneyFromFloat(-15), counter},
+		{counter, model.MoneyFromFloat(15), acc},
+	} {
+		q := mgr.MakeQuery(&model.TransferTx{})
+		q.AddCondition(grumble.HasParent{Parent: check.account.AsKey()})
+		results, err := q.Execute()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("%d transfers in %q, expected 1", len(results), check.account.AccName)
+		}
+		transfer := results[0][0].(*model.TransferTx)
+		if transfer.Amt != check.amt || transfer.CrossPost == nil || transfer.Account == nil || transfer.Account.Id() != check.other.Id() {
+			t.Errorf("Transfer in %q is not cross-posted to %q", check.account.AccName, check.other.AccName)
+		}
+	}
+}
+
+func TestJSONTransactionType(t *testing.T) {
+	acc := makeTestAccount(t, "JSON Type", 0)
+	tx := addTestTransaction(t, acc, time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC), -500, "Type")
+	path := fmt.Sprintf("/json/transaction/%d", tx.Id())
+	for _, check := range []struct {
+		txType string
+		status int
+	}{
+		{model.Transfer, http.StatusBadRequest},
+		{model.OpeningBalance, http.StatusBadRequest},
+		{model.Adjustment, http.StatusBadRequest},
+		{model.Credit, http.StatusOK},
+		{model.Debit, http.StatusOK},
+	} {
+		body := fmt.Sprintf(`{"TXType": %q}`, check.txType)
+		if status := jsonRequest(http.MethodPatch, path, body); status != check.status {
+			t.Errorf("PATCH %s returned status %d, expected %d", body, status, check.status)
+		}
+	}
+	kind := grumble.GetKind(&model.OpeningBalanceTx{}).Kind
+	path = fmt.Sprintf("/json/%s?parentkind=account&parentid=%d", kind, acc.Id())
+	if status := jsonRequest(http.MethodPost, path, `{"Date": "2019-01-01T00:00:00Z", "TXType": "D"}`); status != http.StatusBadRequest {
+		t.Errorf("POST of a debit opening balance returned status %d, expected %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestCSVReimport(t *testing.T) {
+	var err error
+	err = mgr.TX(func(db *sql.DB) (err error) {
+		acc, err := model.GetAccountByName(mgr, "ManulifeOne")
+		if err != nil {
+			return
+		}
+		txImport, err := tximport.MakeTXImport(acc, "data/ManulifeOne/initial/02212019_Transactions.csv")
+		if err != nil {
+			return
+		}
+		if err = txImport.Read(); err != nil {
+			return
+		}
+		if txImport.Good > 0 || txImport.Skipped == 0 {
+			t.Errorf("Re-import: %d good, %d skipped", txImport.Good, txImport.Skipped)
+		}
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCSVPreview(t *testing.T) {
+	acc, err := model.GetAccountByName(mgr, "ManulifeOne")
+	if err != nil {
+		t.Fatal(err)
+	}
+	preview, err := tximport.Preview(acc, "data/ManulifeOne/initial/02212019_Transactions.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(preview.Lines) != preview.Total {
+		t.Errorf("Preview has %d lines for %d records", len(preview.Lines), preview.Total)
+	}
+	for _, line := range preview.Lines {
+		if line.Skipped && (line.Date.IsZero() || line.Amount == 0 || line.Description == "") {
+			t.Errorf("Skipped line %d lacks date, amount or description", line.Line)
+		}
+	}
+}
+
+func TestCSVPreviewTokens(t *testing.T) {
+	acc := makeTestAccount(t, "Preview Tokens", 0)
+	other := filepath.Join(os.TempDir(), fmt.Sprintf("preview-%d-1.csv", acc.Id()+1))
+	expired := filepath.Join(os.TempDir(), fmt.Sprintf("preview-%d-2.csv", acc.Id()))
+	for _, fileName := range []string{other, expired} {
+		if err := ioutil.WriteFile(fileName, []byte("Date,Amount\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(fileName)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/account/confirm/%d", acc.Id()),
+		strings.NewReader("token="+filepath.Base(other)))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tximport.ConfirmCSV(w, r)
+	if location := w.Header().Get("Location"); location != fmt.Sprintf("/account/error/%d", acc.Id()) {
+		t.Errorf("Confirming the preview of another account redirected to %q", location)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("Confirming the preview of another account removed its file: %s", err)
+	}
+
+	old := time.Now().Add(-2 * tximport.PreviewExpiry)
+	if err := os.Chtimes(expired, old, old); err != nil {
+		t.Fatal(err)
+	}
+	tximport.ExpirePreviews()
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("Expired preview file was not removed")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("Recent preview file was removed: %s", err)
+	}
+}
@@ -20,11 +20,15 @@
 package handler
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/JanDeVisser/grumble"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strconv"
 	"strings"
@@ -45,17 +49,37 @@ func (req *JSONRequest) Execute() {
 	if m.IsValid() {
 		m.Call([]reflect.Value{})
 	} else {
-		panic(fmt.Sprintf("Cannot serve method %q for JSON requests", req.Method))
+		req.w.Header().Set("Allow", "GET, POST, PUT, PATCH, DELETE")
+		req.WriteError(errors.New(fmt.Sprintf("Cannot serve method %q for JSON requests", req.Method)),
+			http.StatusMethodNotAllowed)
 	}
 }
 
+// WriteError returns the error as a JSON object with an "error" member.
+func (req *JSONRequest) WriteError(err error, status int) {
+	jsonText, e := json.Marshal(map[string]string{"error": err.Error()})
+	if e != nil {
+		http.Error(req.w, err.Error(), status)
+		return
+	}
+	req.w.Header().Add("Content-type", "text/json")
+	req.w.WriteHeader(status)
+	_, _ = req.w.Write(jsonText)
+	_, _ = req.w.Write([]byte("\n"))
+}
+
 func (req *JSONRequest) WriteJSON(obj interface{}) {
+	req.writeJSON(obj, http.StatusOK)
+}
+
+func (req *JSONRequest) writeJSON(obj interface{}, status int) {
 	jsonText, err := json.Marshal(obj)
 	if err != nil {
 		http.Error(req.w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	req.w.Header().Add("Content-type", "text/json")
+	req.w.WriteHeader(status)
 	_, err = req.w.Write(jsonText)
 	if err != nil {
 		http.Error(req.w, err.Error(), http.StatusInternalServerError)
@@ -64,6 +88,35 @@ func (req *JSONRequest) WriteJSON(obj interface{}) {
 	_, err = req.w.Write([]byte("\n"))
 }
 
+// ResultsProcessor is implemented by kinds which need to post-process the
+// results of a JSON query, e.g. to compute values which cannot be expressed
+// in SQL or to select a page of the results. Errors are taken to be caused by
+// invalid query parameters and are returned to the client with status 400.
+type ResultsProcessor interface {
+	ProcessResults(results [][]grumble.Persistable, values url.Values) ([][]grumble.Persistable, error)
+}
+
+// processResults hands the results to the ResultsProcessor of the kind,
+// if it has one. Empty results are processed as well, so that processors
+// can reject invalid parameters.
+func (req *JSONRequest) processResults(obj interface{}, values url.Values) (ret interface{}, err error) {
+	ret = obj
+	results, ok := obj.([][]grumble.Persistable)
+	if !ok {
+		return
+	}
+	var e grumble.Persistable
+	if len(results) > 0 && len(results[0]) > 0 {
+		e = results[0][0]
+	} else if e, err = req.mgr.Make(req.Kind, nil, 0); err != nil {
+		return
+	}
+	if processor, ok := e.(ResultsProcessor); ok {
+		ret, err = processor.ProcessResults(results, values)
+	}
+	return
+}
+
 func (req *JSONRequest) GET() {
 	var obj interface{}
 	var err error
@@ -73,6 +126,12 @@ func (req *JSONRequest) GET() {
 	} else {
 		log.Printf("JSON.GET q=%q", req.r.URL.Query().Encode())
 		obj, err = req.mgr.Query(req.Kind, req.r.URL.Query())
+		if err == nil {
+			if obj, err = req.processResults(obj, req.r.URL.Query()); err != nil {
+				http.Error(req.w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 	}
 	if err != nil {
 		http.Error(req.w, err.Error(), http.StatusInternalServerError)
@@ -81,6 +140,210 @@ func (req *JSONRequest) GET() {
 	req.WriteJSON(obj)
 }
 
+// Validator is implemented by kinds which check the values of an entity
+// before it is created or updated through a JSON request. Validation errors
+// are returned to the client with status 400.
+type Validator interface {
+	Validate() error
+}
+
+// Locker is implemented by kinds whose entities can be locked against
+// changes, e.g. reconciled transactions. Updating or deleting a locked
+// entity is refused with status 409.
+type Locker interface {
+	Locked() bool
+}
+
+// UpdateValidator is implemented by kinds with fields which clients cannot
+// set, e.g. fields maintained by the application. ValidateUpdate is called
+// with the entity as it was before the update, or nil for new entities.
+// Errors are returned to the client with status 400.
+type UpdateValidator interface {
+	ValidateUpdate(before grumble.Persistable) error
+}
+
+// Updater is implemented by kinds which store other entities along with
+// their own changes, e.g. the other side of a transfer. Update is called
+// instead of storing the entity, in a database transaction.
+type Updater interface {
+	Update() error
+}
+
+// Remover is implemented by kinds which need to update other entities when
+// they are deleted. Remove is called instead of deleting the entity, in a
+// database transaction.
+type Remover interface {
+	Remove() error
+}
+
+func (req *JSONRequest) decode(e grumble.Persistable, before grumble.Persistable) (status int, err error) {
+	body, err := ioutil.ReadAll(req.r.Body)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err = json.Unmarshal(body, e); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if validator, ok := e.(Validator); ok {
+		if err = validator.Validate(); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	if validator, ok := e.(UpdateValidator); ok {
+		if err = validator.ValidateUpdate(before); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	return
+}
+
+func (req *JSONRequest) put(e grumble.Persistable) error {
+	if updater, ok := e.(Updater); ok {
+		return req.mgr.TX(func(db *sql.DB) error {
+			return updater.Update()
+		})
+	}
+	return req.mgr.Put(e)
+}
+
+// parentKey returns the key of the parent of a new entity, given by the
+// "parentkind" and "parentid" query parameters, or nil if there is none.
+func (req *JSONRequest) parentKey() (key *grumble.Key, err error) {
+	values := req.r.URL.Query()
+	if values.Get("parentkind") == "" {
+		return
+	}
+	kind := grumble.GetKind(values.Get("parentkind"))
+	if kind == nil {
+		err = errors.New(fmt.Sprintf("Unknown kind '%s'", values.Get("parentkind")))
+		return
+	}
+	id, err := strconv.ParseInt(values.Get("parentid"), 0, 0)
+	if err != nil || id <= 0 {
+		err = errors.New(fmt.Sprintf("Invalid parent id '%s'", values.Get("parentid")))
+		return
+	}
+	return grumble.CreateKey(nil, kind, int(id))
+}
+
+// get returns the entity the request refers to, or writes an error if it
+// does not exist or, if mustUnlock is set, is locked.
+func (req *JSONRequest) get(mustUnlock bool) (e grumble.Persistable) {
+	if req.Id <= 0 {
+		req.WriteError(errors.New(fmt.Sprintf("%s requires an id", req.Method)), http.StatusBadRequest)
+		return
+	}
+	e, err := req.mgr.Get(req.Kind, req.Id)
+	if err != nil {
+		req.WriteError(err, http.StatusInternalServerError)
+		return nil
+	}
+	if e == nil || reflect.ValueOf(e).IsNil() {
+		req.WriteError(errors.New(fmt.Sprintf("No %s with id %d", req.Kind.Kind, req.Id)), http.StatusNotFound)
+		return nil
+	}
+	if locker, ok := e.(Locker); ok && mustUnlock && locker.Locked() {
+		req.WriteError(errors.New(fmt.Sprintf("%s %d is locked", req.Kind.Kind, req.Id)), http.StatusConflict)
+		return nil
+	}
+	return
+}
+
+// POST creates a new entity from the JSON object in the request body. The
+// parent of the entity is given by the "parentkind" and "parentid" query
+// parameters.
+func (req *JSONRequest) POST() {
+	log.Printf("JSON.POST %s", req.Kind.Kind)
+	if req.Id > 0 {
+		req.WriteError(errors.New("POST creates new entities and does not accept an id"), http.StatusBadRequest)
+		return
+	}
+	parent, err := req.parentKey()
+	if err != nil {
+		req.WriteError(err, http.StatusBadRequest)
+		return
+	}
+	e, err := req.mgr.Make(req.Kind, parent, 0)
+	if err != nil {
+		req.WriteError(err, http.StatusInternalServerError)
+		return
+	}
+	if status, err := req.decode(e, nil); err != nil {
+		req.WriteError(err, status)
+		return
+	}
+	if err = req.put(e); err != nil {
+		req.WriteError(err, http.StatusInternalServerError)
+		return
+	}
+	req.writeJSON(e, http.StatusCreated)
+}
+
+// UpdateHook is called after an entity is updated through a JSON request,
+// with the entity as it was before the update.
+type UpdateHook func(before grumble.Persistable, after grumble.Persistable) error
+
+var updateHooks = make(map[string][]UpdateHook)
+
+// AddUpdateHook registers a hook for updates of entities of the kind.
+func AddUpdateHook(kind *grumble.Kind, hook UpdateHook) {
+	updateHooks[kind.Kind] = append(updateHooks[kind.Kind], hook)
+}
+
+// PATCH updates the entity with the fields in the JSON object in the request
+// body. Fields which are not in the object keep their values.
+func (req *JSONRequest) PATCH() {
+	log.Printf("JSON.%s %s.%d", req.Method, req.Kind.Kind, req.Id)
+	before := req.get(true)
+	if before == nil {
+		return
+	}
+	e := req.get(true)
+	if e == nil {
+		return
+	}
+	if status, err := req.decode(e, before); err != nil {
+		req.WriteError(err, status)
+		return
+	}
+	if err := req.put(e); err != nil {
+		req.WriteError(err, http.StatusInternalServerError)
+		return
+	}
+	for _, hook := range updateHooks[req.Kind.Kind] {
+		if err := hook(before, e); err != nil {
+			log.Printf("JSON.%s %s.%d: update hook: %s", req.Method, req.Kind.Kind, req.Id, err)
+		}
+	}
+	req.WriteJSON(e)
+}
+
+// PUT updates the entity in the same way as PATCH.
+func (req *JSONRequest) PUT() {
+	req.PATCH()
+}
+
+func (req *JSONRequest) DELETE() {
+	log.Printf("JSON.DELETE %s.%d", req.Kind.Kind, req.Id)
+	e := req.get(true)
+	if e == nil {
+		return
+	}
+	var err error
+	if remover, ok := e.(Remover); ok {
+		err = req.mgr.TX(func(db *sql.DB) error {
+			return remover.Remove()
+		})
+	} else {
+		err = req.mgr.Delete(e)
+	}
+	if err != nil {
+		req.WriteError(err, http.StatusInternalServerError)
+		return
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+}
+
 func JSON(w http.ResponseWriter, r *http.Request) {
 	fmt.Println(r.URL.RawQuery)
 	mgr, err := grumble.MakeEntityManager()
@@ -31,8 +31,10 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func institution(w http.ResponseWriter, r *http.Request) {
@@ -56,9 +58,26 @@ func institution(w http.ResponseWriter, r *http.Request) {
 	}
 	institution := e.(*model.Institution)
 	err = institution.GetAccounts()
+	if err == nil {
+		err = reportBalances(mgr, r, institution.Accounts)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	render.RenderTemplate(w, "institution", institution)
 }
 
+// reportBalances converts the balances of the accounts into the currency
+// given by the "currency" query parameter, if there is one.
+func reportBalances(mgr *grumble.EntityManager, r *http.Request, accounts []*model.Account) (err error) {
+	currency := strings.ToUpper(r.URL.Query().Get("currency"))
+	if currency != "" {
+		_, err = model.ReportBalances(mgr, accounts, currency, time.Now())
+	}
+	return
+}
+
 func institutions(w http.ResponseWriter, r *http.Request) {
 	mgr, err := grumble.MakeEntityManager()
 	if err != nil {
@@ -80,6 +99,9 @@ func accounts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	accounts, err := model.GetAccounts(mgr, nil)
+	if err == nil {
+		err = reportBalances(mgr, r, accounts)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -170,6 +192,18 @@ func oldMainPage(w http.ResponseWriter, r *http.Request) {
 	render.RenderTemplate(w, "index", ctx)
 }
 
+// dataFile returns the path of the file with the given name in the data
+// directory. Names which lead out of the data directory are refused.
+func dataFile(name string) (fileName string, err error) {
+	name = filepath.Clean(name)
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		err = errors.New(fmt.Sprintf("File %q is not in the data directory", name))
+		return
+	}
+	fileName = filepath.Join("data", name)
+	return
+}
+
 func tools(w http.ResponseWriter, r *http.Request) {
 	RedirectSuccess := func(msg string) {
 		http.Redirect(w, r,
@@ -206,6 +240,59 @@ func tools(w http.ResponseWriter, r *http.Request) {
 		} else {
 			RedirectSuccess("Database reset")
 		}
+	case "matchtransfers":
+		window := tximport.DefaultMatchWindow
+		if w := r.URL.Query().Get("window"); w != "" {
+			var w64 int64
+			if w64, err = strconv.ParseInt(w, 0, 0); err != nil {
+				RedirectError(err)
+				return
+			}
+			window = int(w64)
+		}
+		var match *tximport.TransferMatch
+		if match, err = tximport.MatchTransfers(mgr, window); err != nil {
+			RedirectError(err)
+		} else {
+			RedirectSuccess(match.String())
+		}
+	case "loadrates":
+		name := r.URL.Query().Get("file")
+		if name == "" {
+			name = "exchangerates.csv"
+		}
+		var fileName string
+		if fileName, err = dataFile(name); err != nil {
+			RedirectError(err)
+			return
+		}
+		var count int
+		err = mgr.TX(func(db *sql.DB) (err error) {
+			count, err = model.LoadExchangeRates(mgr, fileName)
+			return
+		})
+		if err != nil {
+			RedirectError(err)
+		} else {
+			RedirectSuccess(fmt.Sprintf("Loaded %d exchange rates", count))
+		}
+	case "recategorize":
+		tximport.Recategorize(w, r)
+	case "migrateprofiles":
+		dir := r.URL.Query().Get("dir")
+		if dir == "" {
+			dir = "data"
+		}
+		var count int
+		err = mgr.TX(func(db *sql.DB) (err error) {
+			count, err = tximport.MigrateImportProfiles(mgr, dir)
+			return
+		})
+		if err != nil {
+			RedirectError(err)
+		} else {
+			RedirectSuccess(fmt.Sprintf("Migrated %d import profiles", count))
+		}
 	default:
 		RedirectError(errors.New(fmt.Sprintf("Unknown tool %q", tool)))
 	}
@@ -222,10 +309,27 @@ func main() {
 	http.HandleFunc("/institutions", institutions)
 	http.HandleFunc("/accounts", mainPage)
 	http.HandleFunc("/account/upload/", tximport.UploadCSV)
+	http.HandleFunc("/account/preview/", tximport.PreviewCSV)
+	http.HandleFunc("/account/confirm/", tximport.ConfirmCSV)
+	http.HandleFunc("/account/imports/", tximport.ImportHistory)
+	http.HandleFunc("/account/templates/", tximport.ImportTemplates)
+	http.HandleFunc("/account/recategorize/", tximport.RecategorizeJSON)
+	http.HandleFunc("/account/coverage/", tximport.AccountCoverage)
+	http.HandleFunc("/account/suggestions/", tximport.RuleSuggestions)
+	http.HandleFunc("/suggestion/accept/", tximport.AcceptSuggestion)
+	http.HandleFunc("/suggestion/reject/", tximport.RejectSuggestion)
+	http.HandleFunc("/account/reconcile/", model.StartReconciliation)
+	http.HandleFunc("/reconciliation/clear/", model.ClearTransaction)
+	http.HandleFunc("/reconciliation/", model.ReconciliationPage)
+	http.HandleFunc("/import/undo/", tximport.UndoImport)
+	http.HandleFunc("/import/rerun/", tximport.RerunImport)
+	http.HandleFunc("/import/coverage/", tximport.ImportCoverage)
+	http.HandleFunc("/import/", tximport.ImportDetails)
 	http.HandleFunc("/account/", mainPage)
 	http.HandleFunc("/category/", mainPage)
 	http.HandleFunc("/schema/upload", model.UploadSchema)
 	http.HandleFunc("/tools/", tools)
+	go tximport.MakeIngester("data", 30*time.Second).Run()
 	fmt.Println("Starting Listener")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
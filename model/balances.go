@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2019.
+ *
+ * This file is part of Finn.
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Foobar.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import (
+	"fmt"
+	"github.com/JanDeVisser/grumble"
+	"net/url"
+	"time"
+)
+
+// ParseDateRange returns the dates in the "from" and "to" query parameters,
+// formatted as YYYY-MM-DD. Missing dates are returned as zero times.
+func ParseDateRange(values url.Values) (from time.Time, to time.Time, err error) {
+	if s := values.Get("from"); s != "" {
+		if from, err = time.Parse("2006-01-02", s); err != nil {
+			return
+		}
+	}
+	if s := values.Get("to"); s != "" {
+		to, err = time.Parse("2006-01-02", s)
+	}
+	return
+}
+
+// onOrBeforeSQL returns the SQL condition that the Date column of the table
+// with the given alias is on or before the day of t. Imported transactions
+// can carry a time of day, so the column is compared with the start of the
+// next day.
+func onOrBeforeSQL(alias string, t time.Time) string {
+	return fmt.Sprintf("%s.\"Date\" < %s", alias, quote(t.AddDate(0, 0, 1).Format("2006-01-02")))
+}
+
+// AfterDay returns true if t falls on a later calendar date than day. The
+// time of day of t does not matter.
+func AfterDay(t time.Time, day time.Time) bool {
+	return t.Format("2006-01-02") > day.Format("2006-01-02")
+}
+
+// dateRangeSQL returns the SQL conditions restricting the Date column of
+// the table with the given alias to the range from - to, each preceded by
+// AND. Both days are included in the range. Zero dates leave that side of
+// the range open.
+func dateRangeSQL(alias string, from time.Time, to time.Time) (sql string) {
+	if !from.IsZero() {
+		sql += fmt.Sprintf(" AND %s.\"Date\" >= %s", alias, quote(from.Format("2006-01-02")))
+	}
+	if !to.IsZero() {
+		sql += " AND " + onOrBeforeSQL(alias, to)
+	}
+	return
+}
+
+// addBalanceSubQuery computes the CurrentBalance of a category, project or
+// contact as the sum of the transactions referring to it through the given
+// field, optionally restricted to a date range.
+func addBalanceSubQuery(q *grumble.Query, field string, from time.Time, to time.Time) *grumble.Query {
+	balance := grumble.SubQuery{
+		QueryTable: grumble.QueryTable{
+			Kind:        grumble.GetKind(&Transaction{}),
+			WithDerived: true,
+			GroupBy:     false,
+			Alias:       "tx",
+		},
+		Where: fmt.Sprintf("(tx.\"%s\").id = k.\"_id\"%s", field, dateRangeSQL("tx", from, to)),
+	}
+	balance.AddSubSelect(grumble.Computed{
+		Formula: "COALESCE(SUM(tx.\"Amt\"), 0)",
+		Name:    "CurrentBalance",
+	})
+	q.AddSubQuery(balance)
+	return q
+}
+
+func balanceQuery(query *grumble.Query, field string, values url.Values) *grumble.Query {
+	from, to, err := ParseDateRange(values)
+	if err != nil {
+		query.AddCondition(grumble.SimpleCondition{SQL: "FALSE"})
+		return query
+	}
+	return addBalanceSubQuery(query, field, from, to)
+}
+
+func (category *Category) GetQuery(q *grumble.Query) *grumble.Query {
+	return addBalanceSubQuery(q, "Category", time.Time{}, time.Time{})
+}
+
+func (category *Category) ManyQuery(query *grumble.Query, values url.Values) *grumble.Query {
+	return balanceQuery(query, "Category", values)
+}
+
+func (project *Project) GetQuery(q *grumble.Query) *grumble.Query {
+	return addBalanceSubQuery(q, "Project", time.Time{}, time.Time{})
+}
+
+func (project *Project) ManyQuery(query *grumble.Query, values url.Values) *grumble.Query {
+	return balanceQuery(query, "Project", values)
+}
+
+func (contact *Contact) GetQuery(q *grumble.Query) *grumble.Query {
+	return addBalanceSubQuery(q, "Contact", time.Time{}, time.Time{})
+}
+
+func (contact *Contact) ManyQuery(query *grumble.Query, values url.Values) *grumble.Query {
+	return balanceQuery(query, "Contact", values)
+}
+
+// Categories and projects are trees, created by importSubTree. The balance
+// of a node can be rolled up to include the balances of all its descendants.
+type rollUp interface {
+	grumble.Persistable
+	balance() *Money
+}
+
+func (category *Category) balance() *Money {
+	return &category.CurrentBalance
+}
+
+func (project *Project) balance() *Money {
+	return &project.CurrentBalance
+}
+
+// RollUpBalances adds the balance of every category or project in the
+// results to the balances of its ancestors. Ancestors which are not part of
+// the results are skipped.
+func RollUpBalances(results [][]grumble.Persistable) {
+	nodes := make(map[int]rollUp)
+	own := make(map[int]Money)
+	for _, row := range results {
+		if node, ok := row[0].(rollUp); ok {
+			nodes[node.Id()] = node
+			own[node.Id()] = *node.balance()
+		}
+	}
+	for id, node := range nodes {
+		for parent := node.Parent(); parent != nil && parent.Id() != 0; {
+			ancestor, ok := nodes[parent.Id()]
+			if !ok {
+				break
+			}
+			*ancestor.balance() += own[id]
+			parent = ancestor.Parent()
+		}
+	}
+}
+
+// ProcessResults rolls up the balances of categories if the query has
+// rollup=true.
+func (category *Category) ProcessResults(results [][]grumble.Persistable, values url.Values) ([][]grumble.Persistable, error) {
+	if values.Get("rollup") == "true" {
+		RollUpBalances(results)
+	}
+	return results, nil
+}
+
+// ProcessResults rolls up the balances of projects if the query has
+// rollup=true.
+func (project *Project) ProcessResults(results [][]grumble.Persistable, values url.Values) ([][]grumble.Persistable, error) {
+	if values.Get("rollup") == "true" {
+		RollUpBalances(results)
+	}
+	return results, nil
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2019.
+ *
+ * This file is part of Finn.
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Foobar.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/grumble"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultCurrency = "CAD"
+
+// ExchangeRate is the value of one unit of currency From in currency To on
+// Date.
+type ExchangeRate struct {
+	grumble.Key
+	Date time.Time
+	From string
+	To   string
+	Rate float64
+}
+
+func (acc *Account) CurrencyCode() string {
+	if acc.Currency == "" {
+		return DefaultCurrency
+	}
+	return acc.Currency
+}
+
+func rateQuery(mgr *grumble.EntityManager, from string, to string, date time.Time) *grumble.Query {
+	q := mgr.MakeQuery(&ExchangeRate{})
+	q.AddCondition(grumble.SimpleCondition{SQL: "k.\"From\" = " + quote(from)})
+	q.AddCondition(grumble.SimpleCondition{SQL: "k.\"To\" = " + quote(to)})
+	q.AddCondition(grumble.SimpleCondition{SQL: "k.\"Date\" <= " + quote(date.Format("2006-01-02"))})
+	q.AddSort(grumble.Sort{Column: "Date"})
+	return q
+}
+
+// rateWindow is the number of days latestRate looks back for a rate before
+// it searches the whole history of the currency pair. grumble queries cannot
+// be limited to the first row, so this keeps lookups of daily or monthly
+// rates from reading all rates ever loaded.
+const rateWindow = 31
+
+// latestRate returns the most recent rate from one currency to another on or
+// before the date, or nil if there is none.
+func latestRate(mgr *grumble.EntityManager, from string, to string, date time.Time) (rate *ExchangeRate, err error) {
+	q := rateQuery(mgr, from, to, date)
+	q.AddCondition(grumble.SimpleCondition{SQL: "k.\"Date\" > " + quote(date.AddDate(0, 0, -rateWindow).Format("2006-01-02"))})
+	results, err := q.Execute()
+	if err == nil && len(results) == 0 {
+		results, err = rateQuery(mgr, from, to, date).Execute()
+	}
+	if err != nil || len(results) == 0 {
+		return
+	}
+	rate = results[len(results)-1][0].(*ExchangeRate)
+	return
+}
+
+// GetExchangeRate returns the rate to convert amounts in currency from into
+// currency to on the given date. The most recent rate on or before the date
+// is used. If there is no rate from one currency to the other, the inverse
+// of the rate the other way around is used.
+func GetExchangeRate(mgr *grumble.EntityManager, from string, to string, date time.Time) (rate float64, err error) {
+	if from == to {
+		return 1, nil
+	}
+	direct, err := latestRate(mgr, from, to, date)
+	if err != nil {
+		return
+	}
+	inverse, err := latestRate(mgr, to, from, date)
+	if err != nil {
+		return
+	}
+	switch {
+	case direct != nil && (inverse == nil || !inverse.Date.After(direct.Date)):
+		rate = direct.Rate
+	case inverse != nil && inverse.Rate != 0:
+		rate = 1 / inverse.Rate
+	default:
+		err = errors.New(fmt.Sprintf("No exchange rate from %s to %s on %s", from, to, date.Format("2006-01-02")))
+	}
+	return
+}
+
+// ConvertMoney converts an amount from one currency into another using the
+// exchange rate on the given date.
+func ConvertMoney(mgr *grumble.EntityManager, amt Money, from string, to string, date time.Time) (ret Money, err error) {
+	rate, err := GetExchangeRate(mgr, from, to, date)
+	if err != nil {
+		return
+	}
+	ret = amt.Mul(rate)
+	return
+}
+
+// SetExchangeRate stores the rate from one currency to another on the date,
+// replacing the rate already stored for that date.
+func SetExchangeRate(mgr *grumble.EntityManager, date time.Time, from string, to string, rate float64) (err error) {
+	q := rateQuery(mgr, from, to, date)
+	q.AddCondition(grumble.SimpleCondition{SQL: "k.\"Date\" = " + quote(date.Format("2006-01-02"))})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	exchangeRate := &ExchangeRate{}
+	if len(results) > 0 {
+		exchangeRate = results[0][0].(*ExchangeRate)
+	} else {
+		exchangeRate.SetManager(mgr)
+	}
+	exchangeRate.Date = date
+	exchangeRate.From = from
+	exchangeRate.To = to
+	exchangeRate.Rate = rate
+	return mgr.Put(exchangeRate)
+}
+
+// LoadExchangeRates reads exchange rates from a CSV file with the columns
+// date (YYYY-MM-DD), from, to and rate, e.g. "2019-01-02,USD,CAD,1.3642". A
+// header line is skipped.
+func LoadExchangeRates(mgr *grumble.EntityManager, fileName string) (count int, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	rdr := csv.NewReader(file)
+	rdr.FieldsPerRecord = 4
+	for line := 1; ; line++ {
+		var record []string
+		if record, err = rdr.Read(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		date, e := time.Parse("2006-01-02", strings.TrimSpace(record[0]))
+		if e != nil {
+			if line == 1 {
+				continue
+			}
+			err = errors.New(fmt.Sprintf("%s line %d: invalid date", fileName, line))
+			return
+		}
+		var rate float64
+		if rate, err = strconv.ParseFloat(strings.TrimSpace(record[3]), 64); err != nil || rate <= 0 {
+			err = errors.New(fmt.Sprintf("%s line %d: invalid rate", fileName, line))
+			return
+		}
+		from := strings.ToUpper(strings.TrimSpace(record[1]))
+		to := strings.ToUpper(strings.TrimSpace(record[2]))
+		if err = SetExchangeRate(mgr, date, from, to, rate); err != nil {
+			return
+		}
+		count++
+	}
+}
+
+// ReportBalances sets ReportingCurrency and ReportingBalance of the accounts,
+// converting their current balances into the reporting currency at the
+// exchange rate on the given date. The rate of each currency is looked up
+// once.
+func ReportBalances(mgr *grumble.EntityManager, accounts []*Account, currency string, date time.Time) (total Money, err error) {
+	rates := make(map[string]float64)
+	for _, acc := range accounts {
+		acc.ReportingCurrency = currency
+		rate, ok := rates[acc.CurrencyCode()]
+		if !ok {
+			if rate, err = GetExchangeRate(mgr, acc.CurrencyCode(), currency, date); err != nil {
+				return
+			}
+			rates[acc.CurrencyCode()] = rate
+		}
+		acc.ReportingBalance = acc.CurrentBalance.Mul(rate)
+		total += acc.ReportingBalance
+	}
+	return
+}
+
+func init() {
+	grumble.GetKind(&ExchangeRate{})
+}
@@ -24,7 +24,9 @@ import (
 	"fmt"
 	"github.com/JanDeVisser/grumble"
 	"net/url"
+	"reflect"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -32,7 +34,7 @@ type Category struct {
 	grumble.Key
 	Name           string
 	Description    string
-	CurrentBalance float64 `grumble:"transient"`
+	CurrentBalance Money `grumble:"transient"`
 }
 
 type Project struct {
@@ -40,7 +42,7 @@ type Project struct {
 	Name           string
 	Description    string
 	Category       *Category
-	CurrentBalance float64 `grumble:"transient"`
+	CurrentBalance Money `grumble:"transient"`
 }
 
 type Contact struct {
@@ -49,7 +51,7 @@ type Contact struct {
 	InteracAddress string
 	AccountInfo    string
 	Category       *Category
-	CurrentBalance float64 `grumble:"transient"`
+	CurrentBalance Money `grumble:"transient"`
 }
 
 type Institution struct {
@@ -90,30 +92,214 @@ const (
 
 type Transaction struct {
 	grumble.Key
-	Date         time.Time
-	TXType       string
-	Amt          float64
-	Currency     string `grumble:"default=CAD"`
-	ForeignAmt   float64
-	Debit        float64 `grumble:"verbosename=Out;formula=(CASE WHEN \"Amt\" < 0 THEN -\"Amt\" ELSE 0 END)"`
-	Credit       float64 `grumble:"verbosename=In;formula=(CASE WHEN \"Amt\" > 0 THEN \"Amt\" ELSE 0 END)"`
-	Description  string
-	Consolidated bool
-	Category     *Category
-	Project      *Project
-	Contact      *Contact
+	Date             time.Time
+	TXType           string
+	Amt              Money
+	Currency         string `grumble:"default=CAD"`
+	ForeignAmt       Money
+	Debit            Money `grumble:"verbosename=Out;formula=(CASE WHEN \"Amt\" < 0 THEN -\"Amt\" ELSE 0 END)"`
+	Credit           Money `grumble:"verbosename=In;formula=(CASE WHEN \"Amt\" > 0 THEN \"Amt\" ELSE 0 END)"`
+	Description      string
+	ExternalId       string
+	ImportId         int
+	Consolidated     bool
+	ReconciliationId int
+	Category         *Category
+	Project          *Project
+	Contact          *Contact
+	Balance          Money `grumble:"transient"`
+}
+
+func (tx *Transaction) copyTo(other *Transaction) {
+	other.Date = tx.Date
+	other.Amt = tx.Amt
+	other.Currency = tx.Currency
+	other.ForeignAmt = tx.ForeignAmt
+	other.Description = tx.Description
+	other.ExternalId = tx.ExternalId
+	other.ImportId = tx.ImportId
+	other.Consolidated = tx.Consolidated
+	other.ReconciliationId = tx.ReconciliationId
+	other.Category = tx.Category
+	other.Project = tx.Project
+	other.Contact = tx.Contact
+}
+
+// Validate checks a transaction created or updated through the JSON API.
+// Transfers and opening balances are separate kinds, so a plain transaction
+// can only be a debit, a credit or an adjustment.
+func (tx *Transaction) Validate() error {
+	return tx.validate(Debit, Credit, Adjustment)
+}
+
+func (tx *Transaction) validate(types ...string) error {
+	if tx.Date.IsZero() {
+		return errors.New("Transaction must have a date")
+	}
+	if tx.TXType == "" {
+		return nil
+	}
+	for _, txType := range types {
+		if tx.TXType == txType {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Invalid transaction type %q", tx.TXType))
+}
+
+func debitOrCredit(txType string) bool {
+	return txType == Debit || txType == Credit
+}
+
+// ValidateUpdate refuses changes to the fields maintained by imports and
+// reconciliations when a transaction is created or updated through the JSON
+// API. before is nil for new transactions.
+func (tx *Transaction) ValidateUpdate(before grumble.Persistable) error {
+	old := &Transaction{}
+	if t := TransactionOf(before); t != nil {
+		old = t
+	}
+	switch {
+	case tx.ImportId != old.ImportId:
+		return errors.New("The import of a transaction cannot be changed")
+	case tx.ReconciliationId != old.ReconciliationId:
+		return errors.New("The reconciliation of a transaction cannot be changed")
+	case tx.Consolidated != old.Consolidated:
+		return errors.New("Transactions can only be cleared by reconciling the account")
+	case before != nil && tx.TXType != old.TXType && !(debitOrCredit(tx.TXType) && debitOrCredit(old.TXType)):
+		return errors.New("The type of a transaction can only be changed from debit to credit or back")
+	}
+	return nil
 }
 
 type OpeningBalanceTx struct {
 	Transaction
 }
 
+func (tx *OpeningBalanceTx) Validate() error {
+	return tx.validate(OpeningBalance)
+}
+
 type TransferTx struct {
 	Transaction
 	CrossPost *TransferTx
 	Account   *Account
 }
 
+func refId(p grumble.Persistable) int {
+	if p == nil || reflect.ValueOf(p).IsNil() {
+		return 0
+	}
+	return p.Id()
+}
+
+func (tx *TransferTx) Validate() error {
+	return tx.validate(Transfer)
+}
+
+// ValidateUpdate also refuses changes to the link between the two sides of
+// a transfer. Transfers are linked by Account.Transfer, so a new transfer
+// needs a counter account but cannot name the other side.
+func (tx *TransferTx) ValidateUpdate(before grumble.Persistable) error {
+	if err := tx.Transaction.ValidateUpdate(before); err != nil {
+		return err
+	}
+	old, ok := before.(*TransferTx)
+	if !ok {
+		old = &TransferTx{}
+	}
+	switch {
+	case refId(tx.CrossPost) != refId(old.CrossPost):
+		return errors.New("The other side of a transfer cannot be set")
+	case before == nil && refId(tx.Account) == 0:
+		return errors.New("Transfer must have a counter account")
+	case before != nil && refId(tx.Account) != refId(old.Account):
+		return errors.New("The counter account of a transfer cannot be changed")
+	}
+	return nil
+}
+
+// counterpart returns the other side of the transfer and the account it is
+// booked in. cross is nil if the transfer is not cross-posted.
+func (tx *TransferTx) counterpart() (cross *TransferTx, counter *Account, err error) {
+	if refId(tx.CrossPost) == 0 {
+		return
+	}
+	if refId(tx.Account) == 0 {
+		err = errors.New(fmt.Sprintf("Transfer %q has no counter account", tx.Description))
+		return
+	}
+	if counter, err = GetAccount(tx.Manager(), tx.Account.Id()); err != nil {
+		return
+	}
+	e, err := tx.Manager().Get(TransferTx{}, tx.CrossPost.Id())
+	if err != nil {
+		return
+	}
+	cross, _ = e.(*TransferTx)
+	return
+}
+
+// RevertCrossPost turns the other side of the transfer into a plain debit or
+// credit transaction. This is done when this side is deleted.
+func (tx *TransferTx) RevertCrossPost() (err error) {
+	cross, counter, err := tx.counterpart()
+	if err != nil || cross == nil {
+		return
+	}
+	return counter.RevertTransfer(cross)
+}
+
+// Update stores a transfer created or changed through the JSON API. New
+// transfers are booked in the counter account as well, and changes of date,
+// amount and description are applied to the other side.
+func (tx *TransferTx) Update() (err error) {
+	if tx.Id() == 0 {
+		var acc, counter *Account
+		if tx.Parent() == nil {
+			return errors.New(fmt.Sprintf("Transfer %q is not booked in an account", tx.Description))
+		}
+		if acc, err = GetAccount(tx.Manager(), tx.Parent().Id()); err != nil {
+			return
+		}
+		if counter, err = GetAccount(tx.Manager(), tx.Account.Id()); err != nil {
+			return
+		}
+		tx.TXType = Transfer
+		return acc.Transfer(tx, counter)
+	}
+	cross, _, err := tx.counterpart()
+	if err != nil {
+		return
+	}
+	if cross != nil {
+		if err = CheckUnlocked(cross); err != nil {
+			return
+		}
+		cross.Date = tx.Date
+		cross.Amt = -tx.Amt
+		cross.Currency = tx.Currency
+		cross.ForeignAmt = -tx.ForeignAmt
+		cross.Description = tx.Description
+		if err = tx.Manager().Put(cross); err != nil {
+			return
+		}
+	}
+	return tx.Manager().Put(tx)
+}
+
+// Remove deletes a transfer through the JSON API. The other side is kept as
+// a plain transaction.
+func (tx *TransferTx) Remove() (err error) {
+	if err = CheckUnlocked(tx); err != nil {
+		return
+	}
+	if err = tx.RevertCrossPost(); err != nil {
+		return
+	}
+	return tx.Manager().Delete(tx)
+}
+
 type Account struct {
 	grumble.Key
 	AccName        string `grumble:"verbosename=Account name;label"`
@@ -122,15 +308,20 @@ type Account struct {
 	Currency       string `grumble:"default=CAD"`
 	Importer       string
 	OpeningDate    time.Time `grumble:"transient"`
-	OpeningBalance float64   `grumble:"transient"`
-	CurrentBalance float64   `grumble:"transient"`
-	TotalDebit     float64   `grumble:"transient"`
-	TotalCredit    float64   `grumble:"transient"`
+	OpeningBalance Money     `grumble:"transient"`
+	CurrentBalance Money     `grumble:"transient"`
+	TotalDebit     Money     `grumble:"transient"`
+	TotalCredit    Money     `grumble:"transient"`
 	InstName       string    `grumble:"transient"` // FIXME
 	InstIdent      int       `grumble:"transient"`
+
+	// The current balance converted into the currency requested by the
+	// user. See ReportBalances.
+	ReportingCurrency string `grumble:"transient"`
+	ReportingBalance  Money  `grumble:"transient"`
 }
 
-func (acc *Account) SetOpeningBalance(date time.Time, balance float64) (err error) {
+func (acc *Account) SetOpeningBalance(date time.Time, balance Money) (err error) {
 	txp, err := acc.MakeTransaction("O")
 	if err != nil {
 		return
@@ -150,12 +341,14 @@ func (acc *Account) MakeTransaction(txType string) (tx grumble.Persistable, err
 	case Transfer:
 		transfer := &TransferTx{}
 		transfer.TXType = txType
-		// Not now dear...
 		tx = transfer
 	case OpeningBalance:
 		opening := &OpeningBalanceTx{}
 		opening.TXType = txType
 		tx = opening
+	default:
+		err = errors.New(fmt.Sprintf("Unknown transaction type %q", txType))
+		return
 	}
 	if tx != nil {
 		_ = tx.Initialize(acc, 0)
@@ -163,6 +356,151 @@ func (acc *Account) MakeTransaction(txType string) (tx grumble.Persistable, err
 	return
 }
 
+// Transfer books the transfer transaction tx, which must belong to this
+// account, against the counter account. A mirror transaction with the negated
+// amount is created in the counter account, and the two transactions are
+// linked through their CrossPost fields.
+func (acc *Account) Transfer(tx *TransferTx, counter *Account) (err error) {
+	if counter == nil {
+		return errors.New(fmt.Sprintf("No counter account for transfer %q", tx.Description))
+	}
+	tx.Account = counter
+	if err = acc.Manager().Put(tx); err != nil {
+		return
+	}
+	txp, err := counter.MakeTransaction(Transfer)
+	if err != nil {
+		return
+	}
+	cross := txp.(*TransferTx)
+	cross.Date = tx.Date
+	cross.Amt = -tx.Amt
+	cross.Currency = tx.Currency
+	cross.ForeignAmt = -tx.ForeignAmt
+	cross.Description = tx.Description
+	cross.ImportId = tx.ImportId
+	cross.Category = tx.Category
+	cross.Project = tx.Project
+	cross.Contact = tx.Contact
+	cross.Account = acc
+	cross.CrossPost = tx
+	if err = acc.Manager().Put(cross); err != nil {
+		return
+	}
+	tx.CrossPost = cross
+	return acc.Manager().Put(tx)
+}
+
+// ConvertToTransfer replaces the independent transactions tx in this account
+// and counterTx in the counter account by a linked pair of transfer
+// transactions. Date, amount and description of both sides are retained.
+func (acc *Account) ConvertToTransfer(tx *Transaction, counter *Account, counterTx *Transaction) (err error) {
+	if err = CheckUnlocked(tx, counterTx); err != nil {
+		return
+	}
+	txp, err := acc.MakeTransaction(Transfer)
+	if err != nil {
+		return
+	}
+	transfer := txp.(*TransferTx)
+	tx.copyTo(&transfer.Transaction)
+	transfer.Account = counter
+	if err = acc.Manager().Put(transfer); err != nil {
+		return
+	}
+	if txp, err = counter.MakeTransaction(Transfer); err != nil {
+		return
+	}
+	cross := txp.(*TransferTx)
+	counterTx.copyTo(&cross.Transaction)
+	cross.Account = acc
+	cross.CrossPost = transfer
+	if err = acc.Manager().Put(cross); err != nil {
+		return
+	}
+	transfer.CrossPost = cross
+	if err = acc.Manager().Put(transfer); err != nil {
+		return
+	}
+	if err = acc.Manager().Delete(tx); err != nil {
+		return
+	}
+	return acc.Manager().Delete(counterTx)
+}
+
+// RevertTransfer replaces the transfer transaction tx in this account by a
+// plain debit or credit transaction. This is used when the other side of the
+// transfer is removed.
+func (acc *Account) RevertTransfer(tx *TransferTx) (err error) {
+	if err = CheckUnlocked(tx); err != nil {
+		return
+	}
+	txType := Debit
+	if tx.Amt > 0 {
+		txType = Credit
+	}
+	txp, err := acc.MakeTransaction(txType)
+	if err != nil {
+		return
+	}
+	plain := txp.(*Transaction)
+	tx.Transaction.copyTo(plain)
+	if err = acc.Manager().Put(plain); err != nil {
+		return
+	}
+	return acc.Manager().Delete(tx)
+}
+
+func GetAccountByName(mgr *grumble.EntityManager, name string) (account *Account, err error) {
+	e, err := mgr.By(grumble.GetKind(&Account{}), "AccName", name)
+	if err != nil {
+		return
+	}
+	if e == nil {
+		err = errors.New(fmt.Sprintf("No account with name %q found", name))
+		return
+	}
+	account = e.(*Account)
+	return
+}
+
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// HasTransaction returns true if the account holds a transaction with the
+// given ExternalId, i.e. if the statement line with that id was imported
+// before.
+func (acc *Account) HasTransaction(externalId string) (ret bool, err error) {
+	q := acc.Manager().MakeQuery(&Transaction{})
+	q.WithDerived = true
+	q.AddCondition(grumble.HasParent{Parent: acc.AsKey()})
+	q.AddCondition(grumble.SimpleCondition{SQL: "k.\"ExternalId\" = " + quote(externalId)})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	ret = len(results) > 0
+	return
+}
+
+// HasTransfer returns true if the account holds a transfer with the given
+// date and amount from or to the counter account. This happens when the
+// other side of a transfer was imported first.
+func (acc *Account) HasTransfer(counter *Account, date time.Time, amt Money) (ret bool, err error) {
+	q := acc.Manager().MakeQuery(&TransferTx{})
+	q.AddCondition(grumble.HasParent{Parent: acc.AsKey()})
+	q.AddCondition(grumble.SimpleCondition{SQL: fmt.Sprintf("(k.\"Account\").id = %d", counter.Id())})
+	q.AddCondition(grumble.SimpleCondition{SQL: "k.\"Date\" = " + quote(date.Format("2006-01-02"))})
+	q.AddCondition(grumble.SimpleCondition{SQL: fmt.Sprintf("k.\"Amt\" = %s", amt)})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	ret = len(results) > 0
+	return
+}
+
 func GetAccounts(mgr *grumble.EntityManager, institution *Institution) (accounts []*Account, err error) {
 	return accountQuery(mgr, institution, 0)
 }
@@ -195,6 +533,113 @@ func GetAccountQuery(mgr *grumble.EntityManager, institution *Institution, id in
 }
 
 func addTransactionJoin(q *grumble.Query) *grumble.Query {
+	return addPeriodBalances(q, time.Time{}, time.Time{})
+}
+
+// addPeriodBalances computes the balances of accounts for the statement
+// period from - to. OpeningDate and OpeningBalance are the date and balance
+// at the start of the period, TotalDebit and TotalCredit the sums of the
+// transactions in the period, and CurrentBalance is the closing balance. If
+// both dates are zero, the opening balance is that of the account's opening
+// balance transaction and all transactions are included.
+func addPeriodBalances(q *grumble.Query, from time.Time, to time.Time) *grumble.Query {
+	if from.IsZero() && to.IsZero() {
+		addAllTimeBalances(q)
+	} else {
+		addRangeBalances(q, from, to)
+	}
+	addInstSubSelect := false
+	for _, j := range q.Joins {
+		if j.FieldName == "_parent" && j.Direction == grumble.Out {
+			q.RemoveJoin(j.Alias)
+			addInstSubSelect = true
+			break
+		}
+	}
+
+	// FIXME This should be handled in the Query - all 'Outgoing' joins should be added to
+	// the GROUP BY clause if the the grouping is on the main QueryTable.
+	if addInstSubSelect {
+		institution := grumble.SubQuery{
+			QueryTable: grumble.QueryTable{
+				Kind:        grumble.GetKind(&Institution{}),
+				WithDerived: true,
+				GroupBy:     false,
+				Alias:       "institution",
+			},
+			Where: "(k.\"_parent\"[1]).id = institution.\"_id\"",
+		}
+		institution.AddSubSelect(grumble.Computed{
+			Formula: "institution.\"Name\"",
+			Name:    "InstName",
+		})
+		institution.AddSubSelect(grumble.Computed{
+			Formula: "institution.\"_id\"",
+			Name:    "InstIdent",
+		})
+		q.AddSubQuery(institution)
+	}
+	return q
+}
+
+func accountTxSubQuery(alias string, where string) grumble.SubQuery {
+	return grumble.SubQuery{
+		QueryTable: grumble.QueryTable{
+			Kind:        grumble.GetKind(&Transaction{}),
+			WithDerived: true,
+			GroupBy:     false,
+			Alias:       alias,
+		},
+		Where: fmt.Sprintf("(%s.\"_parent\"[1]).id = k.\"_id\"%s", alias, where),
+	}
+}
+
+func addRangeBalances(q *grumble.Query, from time.Time, to time.Time) {
+	// Without a start date the period starts with the first transaction,
+	// so the opening balance is zero.
+	opening := accountTxSubQuery("opening", "")
+	if !from.IsZero() {
+		opening.Where += " AND opening.\"Date\" < " + quote(from.Format("2006-01-02"))
+		opening.AddSubSelect(grumble.Computed{
+			Formula: quote(from.Format("2006-01-02")) + "::date",
+			Name:    "OpeningDate",
+		})
+		opening.AddSubSelect(grumble.Computed{
+			Formula: "COALESCE(SUM(opening.\"Amt\"), 0)",
+			Name:    "OpeningBalance",
+		})
+	} else {
+		opening.AddSubSelect(grumble.Computed{
+			Formula: "COALESCE(MIN(opening.\"Date\"), NOW())",
+			Name:    "OpeningDate",
+		})
+		opening.AddSubSelect(grumble.Computed{
+			Formula: "0",
+			Name:    "OpeningBalance",
+		})
+	}
+	q.AddSubQuery(opening)
+
+	period := accountTxSubQuery("period", dateRangeSQL("period", from, to))
+	period.AddSubSelect(grumble.Computed{
+		Formula: "COALESCE(SUM(CASE WHEN period.\"Amt\" < 0 THEN -period.\"Amt\" ELSE 0 END), 0)",
+		Name:    "TotalDebit",
+	})
+	period.AddSubSelect(grumble.Computed{
+		Formula: "COALESCE(SUM(CASE WHEN period.\"Amt\" > 0 THEN period.\"Amt\" ELSE 0 END), 0)",
+		Name:    "TotalCredit",
+	})
+	q.AddSubQuery(period)
+
+	closing := accountTxSubQuery("closing", dateRangeSQL("closing", time.Time{}, to))
+	closing.AddSubSelect(grumble.Computed{
+		Formula: "COALESCE(SUM(closing.\"Amt\"), 0)",
+		Name:    "CurrentBalance",
+	})
+	q.AddSubQuery(closing)
+}
+
+func addAllTimeBalances(q *grumble.Query) {
 	q.GroupBy = true
 	txJoin := grumble.Join{
 		QueryTable: grumble.QueryTable{
@@ -211,14 +656,14 @@ func addTransactionJoin(q *grumble.Query) *grumble.Query {
 		Function: "SUM",
 		Column:   "Debit",
 		Name:     "TotalDebit",
-		Default:  "0.0",
+		Default:  "0",
 		Query:    nil,
 	})
 	txJoin.AddAggregate(grumble.Aggregate{
 		Function: "SUM",
 		Column:   "Credit",
 		Name:     "TotalCredit",
-		Default:  "0.0",
+		Default:  "0",
 		Query:    nil,
 	})
 	q.AddJoin(txJoin)
@@ -236,47 +681,15 @@ func addTransactionJoin(q *grumble.Query) *grumble.Query {
 		Name:    "OpeningDate",
 	})
 	openingBalance.AddSubSelect(grumble.Computed{
-		Formula: "COALESCE(SUM(opening.\"Amt\"), 0.0)",
+		Formula: "COALESCE(SUM(opening.\"Amt\"), 0)",
 		Name:    "OpeningBalance",
 	})
 	q.AddSubQuery(openingBalance)
 	q.AddGlobalComputedColumn(grumble.Computed{
-		Formula: "COALESCE(SUM(tx.\"Amt\"), 0.0)",
+		Formula: "COALESCE(SUM(tx.\"Amt\"), 0)",
 		Name:    "CurrentBalance",
 		Query:   nil,
 	})
-	addInstSubSelect := false
-	for _, j := range q.Joins {
-		if j.FieldName == "_parent" && j.Direction == grumble.Out {
-			q.RemoveJoin(j.Alias)
-			addInstSubSelect = true
-			break
-		}
-	}
-
-	// FIXME This should be handled in the Query - all 'Outgoing' joins should be added to
-	// the GROUP BY clause if the the grouping is on the main QueryTable.
-	if addInstSubSelect {
-		institution := grumble.SubQuery{
-			QueryTable: grumble.QueryTable{
-				Kind:        grumble.GetKind(&Institution{}),
-				WithDerived: true,
-				GroupBy:     false,
-				Alias:       "institution",
-			},
-			Where: "(k.\"_parent\"[1]).id = institution.\"_id\"",
-		}
-		institution.AddSubSelect(grumble.Computed{
-			Formula: "institution.\"Name\"",
-			Name:    "InstName",
-		})
-		institution.AddSubSelect(grumble.Computed{
-			Formula: "institution.\"_id\"",
-			Name:    "InstIdent",
-		})
-		q.AddSubQuery(institution)
-	}
-	return q
 }
 
 func (acc *Account) GetQuery(q *grumble.Query) *grumble.Query {
@@ -294,7 +707,57 @@ func (acc *Account) ManyQuery(query *grumble.Query, values url.Values) (ret *gru
 		k, _ := grumble.CreateKey(nil, grumble.GetKind(&Institution{}), int(id))
 		query.AddCondition(grumble.HasParent{Parent: k})
 	}
-	return addTransactionJoin(query)
+	from, to, err := ParseDateRange(values)
+	if err != nil {
+		query.AddCondition(grumble.SimpleCondition{SQL: "FALSE"})
+	}
+	return addPeriodBalances(query, from, to)
+}
+
+// ProcessResults converts the balances of the accounts into the currency
+// given by the "currency" query parameter, if there is one, at the exchange
+// rate on the "to" date of the statement period or today. See
+// ReportBalances.
+func (acc *Account) ProcessResults(results [][]grumble.Persistable, values url.Values) (ret [][]grumble.Persistable, err error) {
+	ret = results
+	currency := strings.ToUpper(values.Get("currency"))
+	if currency == "" || len(results) == 0 {
+		return
+	}
+	_, to, err := ParseDateRange(values)
+	if err != nil {
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	accounts := make([]*Account, 0, len(results))
+	for _, row := range results {
+		if a, ok := row[0].(*Account); ok {
+			accounts = append(accounts, a)
+		}
+	}
+	if len(accounts) > 0 {
+		_, err = ReportBalances(accounts[0].Manager(), accounts, currency, to)
+	}
+	return
+}
+
+// AddAccountCondition restricts a query to entities whose parent is the
+// account given by the "accountid" query parameter, if there is one. An
+// invalid id matches nothing.
+func AddAccountCondition(query *grumble.Query, values url.Values) *grumble.Query {
+	if values.Get("accountid") == "" {
+		return query
+	}
+	id, err := strconv.ParseInt(values.Get("accountid"), 0, 0)
+	if err != nil {
+		query.AddCondition(grumble.SimpleCondition{SQL: "FALSE"})
+		return query
+	}
+	k, _ := grumble.CreateKey(nil, grumble.GetKind(&Account{}), int(id))
+	query.AddCondition(grumble.HasParent{Parent: k})
+	return query
 }
 
 func accountQuery(mgr *grumble.EntityManager, institution *Institution, id int) (accounts []*Account, err error) {
@@ -316,14 +779,30 @@ func accountQuery(mgr *grumble.EntityManager, institution *Institution, id int)
 
 // --------------------------------------------------------------------------
 
+// ManyQuery restricts the transactions to the account given by accountid,
+// if any, and applies the search and sort parameters described at
+// addSearchConditions and sortColumn.
 func (tx *Transaction) ManyQuery(query *grumble.Query, values url.Values) (ret *grumble.Query) {
 	ret = query
+	if column, _ := sortColumn(values); column != "" {
+		query.AddSort(grumble.Sort{Column: column})
+	}
 	switch {
 	case values.Get("accountid") != "":
 		id, err := strconv.ParseInt(values.Get("accountid"), 0, 0)
 		if err == nil {
 			query = makeTXQuery(query, nil, int(id))
 		}
+	default:
+		query.WithDerived = true
+		query.AddReferenceJoins()
+		query.AddSort(grumble.Sort{Column: "Date"})
+	}
+	if err := addSearchConditions(query, values); err != nil {
+		query.AddCondition(grumble.SimpleCondition{SQL: "FALSE"})
+	}
+	if _, _, err := pageParams(values); err != nil {
+		query.AddCondition(grumble.SimpleCondition{SQL: "FALSE"})
 	}
 	return
 }
@@ -343,9 +822,51 @@ func makeTXQuery(query *grumble.Query, acc *Account, accountid int) *grumble.Que
 	}
 	query.AddReferenceJoins()
 	query.AddSort(grumble.Sort{Column: "Date"})
+	query.AddSort(grumble.Sort{Column: "_id"})
+	addRunningBalance(query)
 	return query
 }
 
+// addRunningBalance computes the balance of the account after every
+// transaction. Transactions are ordered by date and, within a day, by id,
+// i.e. in the order they were booked. Since the balance includes all
+// earlier transactions, it is correct even if the query only returns some
+// of them.
+func addRunningBalance(query *grumble.Query) {
+	running := grumble.SubQuery{
+		QueryTable: grumble.QueryTable{
+			Kind:        grumble.GetKind(&Transaction{}),
+			WithDerived: true,
+			GroupBy:     false,
+			Alias:       "running",
+		},
+		Where: "(running.\"_parent\"[1]).id = (k.\"_parent\"[1]).id AND " +
+			"(running.\"Date\" < k.\"Date\" OR (running.\"Date\" = k.\"Date\" AND running.\"_id\" <= k.\"_id\"))",
+	}
+	running.AddSubSelect(grumble.Computed{
+		Formula: "COALESCE(SUM(running.\"Amt\"), 0)",
+		Name:    "Balance",
+	})
+	query.AddSubQuery(running)
+}
+
+// GetImportedTransactions returns all transactions, including transfers, which
+// were created by the import with the given id.
+func GetImportedTransactions(mgr *grumble.EntityManager, importId int) (txs []grumble.Persistable, err error) {
+	q := mgr.MakeQuery(&Transaction{})
+	q.WithDerived = true
+	q.AddCondition(grumble.SimpleCondition{SQL: fmt.Sprintf("k.\"ImportId\" = %d", importId)})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	txs = make([]grumble.Persistable, len(results))
+	for ix, row := range results {
+		txs[ix] = row[0]
+	}
+	return
+}
+
 func (acc *Account) GetTransactions() (txs []*Transaction, err error) {
 	q := acc.Manager().MakeQuery(&Transaction{})
 	q = makeTXQuery(q, acc, 0)
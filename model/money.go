@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2019.
+ *
+ * This file is part of Finn.
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Foobar.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount of money, stored as a number of cents. Sums of
+// Money values do not drift the way float64 sums do. In the database Money
+// is stored in a NUMERIC column, and in JSON it is written as a string with
+// two decimals, e.g. "-12.34".
+type Money int64
+
+// MoneyFromFloat converts a float amount to Money, rounding to the nearest
+// cent.
+func MoneyFromFloat(f float64) Money {
+	return Money(math.Round(f * 100))
+}
+
+// ParseMoney parses a decimal amount like "-1234.5" exactly. More than two
+// decimals are rounded half away from zero.
+func ParseMoney(s string) (m Money, err error) {
+	str := strings.TrimSpace(s)
+	negative := false
+	switch {
+	case strings.HasPrefix(str, "-"):
+		negative = true
+		str = str[1:]
+	case strings.HasPrefix(str, "+"):
+		str = str[1:]
+	}
+	whole, fraction := str, ""
+	if ix := strings.Index(str, "."); ix >= 0 {
+		whole, fraction = str[:ix], str[ix+1:]
+	}
+	if whole == "" && fraction == "" {
+		err = errors.New(fmt.Sprintf("Invalid amount %q", s))
+		return
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	for len(fraction) < 3 {
+		fraction += "0"
+	}
+	for _, digits := range []string{whole, fraction} {
+		if strings.TrimLeft(digits, "0123456789") != "" {
+			err = errors.New(fmt.Sprintf("Invalid amount %q", s))
+			return
+		}
+	}
+	var w, f int64
+	if w, err = strconv.ParseInt(whole, 10, 64); err != nil {
+		err = errors.New(fmt.Sprintf("Invalid amount %q", s))
+		return
+	}
+	f, _ = strconv.ParseInt(fraction[:2], 10, 64)
+	m = Money(w*100 + f)
+	if fraction[2] >= '5' {
+		m++
+	}
+	if negative {
+		m = -m
+	}
+	return
+}
+
+func (m Money) Float() float64 {
+	return float64(m) / 100
+}
+
+func (m Money) Abs() Money {
+	if m < 0 {
+		return -m
+	}
+	return m
+}
+
+// Mul multiplies the amount by a factor, e.g. an exchange rate, rounding to
+// the nearest cent.
+func (m Money) Mul(factor float64) Money {
+	return Money(math.Round(float64(m) * factor))
+}
+
+func (m Money) String() string {
+	sign := ""
+	abs := int64(m)
+	if abs < 0 {
+		sign = "-"
+		abs = -abs
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, abs/100, abs%100)
+}
+
+// Format makes Money print like a float with two decimals for the %f, %g,
+// %e, %s and %v verbs, honouring the width and the - and + flags.
+func (m Money) Format(f fmt.State, verb rune) {
+	s := m.String()
+	switch verb {
+	case 'f', 'F', 'g', 'G', 'e', 'E', 's', 'v':
+		if f.Flag('+') && m >= 0 {
+			s = "+" + s
+		}
+	case 'd':
+		s = strconv.FormatInt(int64(m), 10)
+	default:
+		s = fmt.Sprintf("%%!%c(model.Money=%s)", verb, s)
+	}
+	if width, ok := f.Width(); ok && len(s) < width {
+		pad := strings.Repeat(" ", width-len(s))
+		if f.Flag('-') {
+			s += pad
+		} else {
+			s = pad + s
+		}
+	}
+	_, _ = f.Write([]byte(s))
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON accepts both strings and numbers.
+func (m *Money) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(data, &s); err != nil {
+		s = string(data)
+	}
+	*m, err = ParseMoney(s)
+	return
+}
+
+// Scan reads Money from NUMERIC columns and aggregates, which the driver
+// returns as text, or from float and integer expressions. Like the text
+// written by Value, all of these are amounts in currency units and not in
+// cents, so an integer 12 is read as 12.00.
+func (m *Money) Scan(src interface{}) (err error) {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+	case []byte:
+		*m, err = ParseMoney(string(v))
+	case string:
+		*m, err = ParseMoney(v)
+	case float64:
+		*m = MoneyFromFloat(v)
+	case int64:
+		*m, err = ParseMoney(strconv.FormatInt(v, 10))
+	default:
+		err = errors.New(fmt.Sprintf("Cannot convert %T to Money", src))
+	}
+	return
+}
+
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// SQLType is the column type used to store Money.
+func (m Money) SQLType() string {
+	return "NUMERIC(18,2)"
+}
@@ -0,0 +1,435 @@
+/*
+ * Copyright (c) 2019.
+ *
+ * This file is part of Finn.
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Foobar.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/finn/render"
+	"github.com/JanDeVisser/grumble"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	ReconciliationOpen      = "Open"
+	ReconciliationCompleted = "Completed"
+)
+
+// Reconciliation checks the transactions of an account against a bank
+// statement. Transactions are ticked as cleared by setting their
+// Consolidated flag. Once the cleared balance matches the statement
+// balance the reconciliation can be completed, which locks the cleared
+// transactions.
+type Reconciliation struct {
+	grumble.Key
+	StatementDate    time.Time
+	StatementBalance Money
+	Status           string
+	ClearedBalance   Money `grumble:"transient"`
+	Difference       Money `grumble:"transient"`
+}
+
+var ErrLocked = errors.New("Transaction is part of a completed reconciliation and cannot be changed")
+
+// Locked returns true if the transaction was cleared in a completed
+// reconciliation.
+func (tx *Transaction) Locked() bool {
+	return tx.ReconciliationId != 0
+}
+
+// CheckUnlocked returns ErrLocked if any of the transactions is locked.
+// Everything changing or deleting existing transactions calls it first.
+func CheckUnlocked(txs ...grumble.Persistable) error {
+	for _, p := range txs {
+		if tx := TransactionOf(p); tx != nil && tx.Locked() {
+			return ErrLocked
+		}
+	}
+	return nil
+}
+
+// TransactionOf returns the Transaction embedded in a transaction entity of
+// any type.
+func TransactionOf(p grumble.Persistable) *Transaction {
+	switch tx := p.(type) {
+	case *OpeningBalanceTx:
+		return &tx.Transaction
+	case *TransferTx:
+		return &tx.Transaction
+	case *Transaction:
+		return tx
+	}
+	return nil
+}
+
+// StartReconciliation opens a reconciliation of the account against the
+// statement with the given closing date and balance. An account can only
+// have one open reconciliation.
+func (acc *Account) StartReconciliation(date time.Time, balance Money) (rec *Reconciliation, err error) {
+	open, err := acc.OpenReconciliation()
+	if err != nil {
+		return
+	}
+	if open != nil {
+		err = errors.New(fmt.Sprintf("Account %q already has an open reconciliation", acc.AccName))
+		return
+	}
+	rec = &Reconciliation{StatementDate: date, StatementBalance: balance, Status: ReconciliationOpen}
+	rec.Initialize(acc, 0)
+	if err = acc.Manager().Put(rec); err != nil {
+		return
+	}
+	err = rec.Compute()
+	return
+}
+
+// OpenReconciliation returns the open reconciliation of the account, or nil
+// if there is none.
+func (acc *Account) OpenReconciliation() (rec *Reconciliation, err error) {
+	q := acc.Manager().MakeQuery(&Reconciliation{})
+	q.AddCondition(grumble.HasParent{Parent: acc.AsKey()})
+	q.AddCondition(grumble.SimpleCondition{SQL: "k.\"Status\" = " + quote(ReconciliationOpen)})
+	results, err := q.Execute()
+	if err != nil || len(results) == 0 {
+		return
+	}
+	rec = results[0][0].(*Reconciliation)
+	return
+}
+
+func GetReconciliation(mgr *grumble.EntityManager, id int) (rec *Reconciliation, err error) {
+	e, err := mgr.Get(Reconciliation{}, id)
+	if err != nil {
+		return
+	}
+	rec, ok := e.(*Reconciliation)
+	if !ok || rec == nil {
+		err = errors.New(fmt.Sprintf("No reconciliation with ID %d found", id))
+		return
+	}
+	err = rec.Compute()
+	return
+}
+
+func (rec *Reconciliation) Account() (*Account, error) {
+	return GetAccount(rec.Manager(), rec.Parent().Id())
+}
+
+// Transactions returns the transactions of the account up to the statement
+// date which were not locked by an earlier reconciliation.
+func (rec *Reconciliation) Transactions() (txs []*Transaction, err error) {
+	acc, err := rec.Account()
+	if err != nil {
+		return
+	}
+	q := rec.Manager().MakeQuery(&Transaction{})
+	q = makeTXQuery(q, acc, 0)
+	q.AddCondition(grumble.SimpleCondition{SQL: onOrBeforeSQL("k", rec.StatementDate)})
+	q.AddCondition(grumble.SimpleCondition{SQL: fmt.Sprintf("k.\"ReconciliationId\" IN (0, %d)", rec.Id())})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	txs = make([]*Transaction, 0, len(results))
+	for _, row := range results {
+		if tx := TransactionOf(row[0]); tx != nil {
+			txs = append(txs, tx)
+		}
+	}
+	return
+}
+
+// Compute sets the cleared balance, i.e. the sum of all cleared
+// transactions up to the statement date, and its difference with the
+// statement balance.
+func (rec *Reconciliation) Compute() (err error) {
+	q := rec.Manager().MakeQuery(&Transaction{})
+	q.WithDerived = true
+	q.AddCondition(grumble.HasParent{Parent: rec.Parent()})
+	q.AddCondition(grumble.SimpleCondition{SQL: "k.\"Consolidated\""})
+	q.AddCondition(grumble.SimpleCondition{SQL: onOrBeforeSQL("k", rec.StatementDate)})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	rec.ClearedBalance = 0
+	for _, row := range results {
+		if tx := TransactionOf(row[0]); tx != nil {
+			rec.ClearedBalance += tx.Amt
+		}
+	}
+	rec.Difference = rec.StatementBalance - rec.ClearedBalance
+	return
+}
+
+// Clear ticks the transaction with the given id as cleared, or unticks it.
+func (rec *Reconciliation) Clear(txId int, cleared bool) (err error) {
+	if rec.Status != ReconciliationOpen {
+		return errors.New("Reconciliation is already completed")
+	}
+	e, err := rec.Manager().Get(Transaction{}, txId)
+	if err != nil {
+		return
+	}
+	tx := TransactionOf(e)
+	if tx == nil || tx.Parent() == nil || tx.Parent().Id() != rec.Parent().Id() {
+		return errors.New(fmt.Sprintf("Transaction %d does not belong to the account being reconciled", txId))
+	}
+	if err = CheckUnlocked(e); err != nil {
+		return
+	}
+	if AfterDay(tx.Date, rec.StatementDate) {
+		return errors.New(fmt.Sprintf("Transaction %q is after the statement date", tx.Description))
+	}
+	if tx.Consolidated != cleared {
+		tx.Consolidated = cleared
+		if err = rec.Manager().Put(e); err != nil {
+			return
+		}
+	}
+	return rec.Compute()
+}
+
+// Complete closes the reconciliation and locks the cleared transactions. It
+// fails if the cleared balance does not match the statement balance.
+func (rec *Reconciliation) Complete() (err error) {
+	if rec.Status != ReconciliationOpen {
+		return errors.New("Reconciliation is already completed")
+	}
+	if err = rec.Compute(); err != nil {
+		return
+	}
+	if rec.Difference != 0 {
+		return errors.New(fmt.Sprintf("Cleared balance %s differs %s from the statement balance %s",
+			rec.ClearedBalance, rec.Difference, rec.StatementBalance))
+	}
+	return rec.Manager().TX(func(db *sql.DB) (err error) {
+		q := rec.Manager().MakeQuery(&Transaction{})
+		q.WithDerived = true
+		q.AddCondition(grumble.HasParent{Parent: rec.Parent()})
+		q.AddCondition(grumble.SimpleCondition{SQL: "k.\"Consolidated\""})
+		q.AddCondition(grumble.SimpleCondition{SQL: "k.\"ReconciliationId\" = 0"})
+		q.AddCondition(grumble.SimpleCondition{SQL: onOrBeforeSQL("k", rec.StatementDate)})
+		var results [][]grumble.Persistable
+		if results, err = q.Execute(); err != nil {
+			return
+		}
+		for _, row := range results {
+			if tx := TransactionOf(row[0]); tx != nil {
+				tx.ReconciliationId = rec.Id()
+				if err = rec.Manager().Put(row[0]); err != nil {
+					return
+				}
+			}
+		}
+		rec.Status = ReconciliationCompleted
+		return rec.Manager().Put(rec)
+	})
+}
+
+func (rec *Reconciliation) ManyQuery(query *grumble.Query, values url.Values) (ret *grumble.Query) {
+	ret = AddAccountCondition(query, values)
+	query.AddSort(grumble.Sort{Column: "StatementDate"})
+	return
+}
+
+// ProcessResults computes the cleared balances of the reconciliations.
+func (rec *Reconciliation) ProcessResults(results [][]grumble.Persistable, values url.Values) ([][]grumble.Persistable, error) {
+	for _, row := range results {
+		if r, ok := row[0].(*Reconciliation); ok {
+			if err := r.Compute(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// --------------------------------------------------------------------------
+
+func renderReconciliation(w http.ResponseWriter, rec *Reconciliation) {
+	acc, err := rec.Account()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	txs, err := rec.Transactions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx := make(map[string]interface{})
+	ctx["Account"] = acc
+	ctx["Reconciliation"] = rec
+	ctx["Transactions"] = txs
+	render.RenderTemplate(w, "reconciliation", ctx)
+}
+
+// StartReconciliation handles POST /account/reconcile/<id> with the
+// statement date (YYYY-MM-DD) and balance.
+func StartReconciliation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Reconciliations can only be started using POST", http.StatusMethodNotAllowed)
+		return
+	}
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		RedirectError(w, r, err)
+		return
+	}
+	id, err := PathId(r)
+	if err != nil {
+		RedirectError(w, r, err)
+		return
+	}
+	acc, err := GetAccount(mgr, id)
+	if err != nil {
+		RedirectError(w, r, err)
+		return
+	}
+	date, err := time.Parse("2006-01-02", r.FormValue("date"))
+	if err != nil {
+		RedirectError(w, r, err)
+		return
+	}
+	balance, err := ParseMoney(r.FormValue("balance"))
+	if err != nil {
+		RedirectError(w, r, err)
+		return
+	}
+	rec, err := acc.StartReconciliation(date, balance)
+	if err != nil {
+		RedirectError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/reconciliation/%d", rec.Id()), http.StatusSeeOther)
+}
+
+// ReconciliationPage shows the reconciliation with the transactions which
+// can be ticked. A POST saves the ticks: all transactions listed in the
+// form's "txid" values are cleared, those in "shown" but not in "txid" are
+// unticked.
+func ReconciliationPage(w http.ResponseWriter, r *http.Request) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := PathId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rec, err := GetReconciliation(mgr, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if err = r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cleared := make(map[string]bool)
+		for _, txId := range r.Form["txid"] {
+			cleared[txId] = true
+		}
+		err = mgr.TX(func(db *sql.DB) (err error) {
+			for _, txId := range r.Form["shown"] {
+				var id64 int64
+				if id64, err = strconv.ParseInt(txId, 0, 0); err != nil {
+					return
+				}
+				if err = rec.Clear(int(id64), cleared[txId]); err != nil {
+					return
+				}
+			}
+			return
+		})
+		if err != nil {
+			RedirectError(w, r, err)
+			return
+		}
+		if r.FormValue("complete") != "" {
+			if err = rec.Complete(); err != nil {
+				RedirectError(w, r, err)
+				return
+			}
+		}
+		http.Redirect(w, r, fmt.Sprintf("/reconciliation/%d", rec.Id()), http.StatusSeeOther)
+		return
+	}
+	renderReconciliation(w, rec)
+}
+
+// ClearTransaction is the JSON API to tick a single transaction:
+// POST /reconciliation/clear/<id>?txid=<txid>&cleared=true|false. It returns
+// the reconciliation with its updated cleared balance and difference.
+func ClearTransaction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Transactions can only be cleared using POST", http.StatusMethodNotAllowed)
+		return
+	}
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := PathId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec, err := GetReconciliation(mgr, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	txId, err := strconv.ParseInt(r.FormValue("txid"), 0, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cleared, err := strconv.ParseBool(r.FormValue("cleared"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = rec.Clear(int(txId), cleared); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	jsonText, err := json.Marshal(rec)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-type", "text/json")
+	_, _ = w.Write(jsonText)
+}
+
+func init() {
+	grumble.GetKind(&Reconciliation{})
+}
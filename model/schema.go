@@ -65,6 +65,9 @@ func ImportInstitutions(mgr *grumble.EntityManager, data interface{}) (err error
 			a.AccNr = account["acc_nr"].(string)
 			a.Description = account["description"].(string)
 			a.Importer = account["importer"].(string)
+			if currency, ok := account["currency"].(string); ok {
+				a.Currency = currency
+			}
 			if err = mgr.Put(a); err != nil {
 				return err
 			}
@@ -73,7 +76,7 @@ func ImportInstitutions(mgr *grumble.EntityManager, data interface{}) (err error
 			if err != nil {
 				return
 			}
-			if err = a.SetOpeningBalance(openingDate, account["opening_balance"].(float64)); err != nil {
+			if err = a.SetOpeningBalance(openingDate, MoneyFromFloat(account["opening_balance"].(float64))); err != nil {
 				return
 			}
 		}
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 )
 
 func uploadPage(ctx map[string]interface{}, w http.ResponseWriter, r *http.Request) {
@@ -24,6 +26,15 @@ func RedirectError(w http.ResponseWriter, r *http.Request, err error) {
 	http.Redirect(w, r, fmt.Sprintf("/?error=%s", url.QueryEscape(err.Error())), http.StatusSeeOther)
 }
 
+// PathId returns the entity id in the last element of the request path,
+// e.g. 12 for /account/imports/12.
+func PathId(r *http.Request) (id int, err error) {
+	idStr := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	id64, err := strconv.ParseInt(idStr, 0, 0)
+	id = int(id64)
+	return
+}
+
 func uploadSchema(w http.ResponseWriter, r *http.Request) {
 	// Parse our multipart form, 10 << 20 specifies a maximum
 	// upload of 10 MB files.
@@ -0,0 +1,273 @@
+/*
+ * Copyright (c) 2019.
+ *
+ * This file is part of Finn.
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Foobar.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/grumble"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The columns transactions can be sorted on, by their lower case name.
+var txSortColumns = map[string]string{
+	"date":        "Date",
+	"amt":         "Amt",
+	"description": "Description",
+	"txtype":      "TXType",
+}
+
+// DefaultPageSize is the number of transactions per page if the "page"
+// parameter is given without "pagesize".
+const DefaultPageSize = 50
+
+func likePattern(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "%", "\\%", -1)
+	s = strings.Replace(s, "_", "\\_", -1)
+	return quote("%" + s + "%")
+}
+
+func idParam(values url.Values, name string) (id int, err error) {
+	id64, err := strconv.ParseInt(values.Get(name), 0, 0)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("Invalid %s %q", name, values.Get(name)))
+	}
+	id = int(id64)
+	return
+}
+
+// CategoryTree returns the id of the category and the ids of all its
+// descendants.
+func CategoryTree(mgr *grumble.EntityManager, id int) (ids []int, err error) {
+	results, err := mgr.MakeQuery(&Category{}).Execute()
+	if err != nil {
+		return
+	}
+	children := make(map[int][]int)
+	for _, row := range results {
+		if parent := row[0].Parent(); parent != nil && parent.Id() != 0 {
+			children[parent.Id()] = append(children[parent.Id()], row[0].Id())
+		}
+	}
+	ids = []int{id}
+	for ix := 0; ix < len(ids); ix++ {
+		ids = append(ids, children[ids[ix]]...)
+	}
+	return
+}
+
+// addSearchConditions translates the search parameters of a transaction
+// query into conditions:
+//
+//	description    Description contains the value, case insensitive
+//	regex          Description matches the POSIX regular expression, which
+//	               must also be valid in Go's syntax
+//	minamt, maxamt Amount range, inclusive
+//	from, to       Date range, inclusive
+//	categoryid     Category is the category or one of its descendants
+//	projectid      Project
+//	contactid      Contact
+//	type           Transaction type, or a comma separated list of types
+//	consolidated   true or false
+//	uncategorized  true to only return transactions without a category
+func addSearchConditions(query *grumble.Query, values url.Values) (err error) {
+	if err = checkSearchParams(values); err != nil {
+		return
+	}
+	conditions := make([]string, 0)
+	if s := values.Get("description"); s != "" {
+		conditions = append(conditions, "k.\"Description\" ILIKE "+likePattern(s))
+	}
+	if s := values.Get("regex"); s != "" {
+		conditions = append(conditions, "k.\"Description\" ~* "+quote(s))
+	}
+	for param, op := range map[string]string{"minamt": ">=", "maxamt": "<="} {
+		if s := values.Get(param); s != "" {
+			var amt Money
+			if amt, err = ParseMoney(s); err != nil {
+				return
+			}
+			conditions = append(conditions, fmt.Sprintf("k.\"Amt\" %s %s", op, amt))
+		}
+	}
+	from, to, err := ParseDateRange(values)
+	if err != nil {
+		return
+	}
+	if !from.IsZero() || !to.IsZero() {
+		conditions = append(conditions, "TRUE"+dateRangeSQL("k", from, to))
+	}
+	if values.Get("categoryid") != "" {
+		var id int
+		if id, err = idParam(values, "categoryid"); err != nil {
+			return
+		}
+		var ids []int
+		if ids, err = CategoryTree(query.Manager, id); err != nil {
+			return
+		}
+		list := make([]string, len(ids))
+		for ix, id := range ids {
+			list[ix] = strconv.Itoa(id)
+		}
+		conditions = append(conditions, fmt.Sprintf("(k.\"Category\").id IN (%s)", strings.Join(list, ", ")))
+	}
+	for param, column := range map[string]string{"projectid": "Project", "contactid": "Contact"} {
+		if values.Get(param) != "" {
+			var id int
+			if id, err = idParam(values, param); err != nil {
+				return
+			}
+			conditions = append(conditions, fmt.Sprintf("(k.\"%s\").id = %d", column, id))
+		}
+	}
+	if s := values.Get("type"); s != "" {
+		types := strings.Split(s, ",")
+		for ix, t := range types {
+			types[ix] = quote(strings.TrimSpace(t))
+		}
+		conditions = append(conditions, fmt.Sprintf("k.\"TXType\" IN (%s)", strings.Join(types, ", ")))
+	}
+	if s := values.Get("consolidated"); s != "" {
+		var consolidated bool
+		if consolidated, err = strconv.ParseBool(s); err != nil {
+			return
+		}
+		conditions = append(conditions, fmt.Sprintf("k.\"Consolidated\" = %t", consolidated))
+	}
+	if values.Get("uncategorized") == "true" {
+		conditions = append(conditions, "(k.\"Category\").id IS NULL")
+	}
+	for _, condition := range conditions {
+		query.AddCondition(grumble.SimpleCondition{SQL: condition})
+	}
+	return
+}
+
+// checkSearchParams returns an error if one of the search parameters cannot
+// be used, so that it can be reported to the client before the database
+// rejects the query.
+func checkSearchParams(values url.Values) (err error) {
+	if s := values.Get("regex"); s != "" {
+		if _, e := regexp.Compile(s); e != nil {
+			return errors.New(fmt.Sprintf("Invalid regular expression %q: %s", s, e))
+		}
+	}
+	for _, param := range []string{"minamt", "maxamt"} {
+		if s := values.Get(param); s != "" {
+			if _, e := ParseMoney(s); e != nil {
+				return errors.New(fmt.Sprintf("Invalid %s %q", param, s))
+			}
+		}
+	}
+	if _, _, err = ParseDateRange(values); err != nil {
+		return
+	}
+	for _, param := range []string{"categoryid", "projectid", "contactid"} {
+		if values.Get(param) != "" {
+			if _, err = idParam(values, param); err != nil {
+				return
+			}
+		}
+	}
+	if s := values.Get("type"); s != "" {
+		for _, t := range strings.Split(s, ",") {
+			switch strings.TrimSpace(t) {
+			case Debit, Credit, Transfer, OpeningBalance, Adjustment:
+			default:
+				return errors.New(fmt.Sprintf("Invalid transaction type %q", t))
+			}
+		}
+	}
+	if s := values.Get("consolidated"); s != "" {
+		if _, e := strconv.ParseBool(s); e != nil {
+			return errors.New(fmt.Sprintf("Invalid consolidated %q", s))
+		}
+	}
+	return
+}
+
+// sortColumn returns the column in the "sort" parameter and whether the
+// sort order is descending, which is requested by prefixing the column with
+// a minus sign.
+func sortColumn(values url.Values) (column string, descending bool) {
+	s := values.Get("sort")
+	if strings.HasPrefix(s, "-") {
+		descending = true
+		s = s[1:]
+	}
+	column = txSortColumns[strings.ToLower(s)]
+	return
+}
+
+// pageParams returns the page and page size requested by the "page" and
+// "pagesize" parameters. Pages are numbered from 1; page is 0 if no page is
+// requested.
+func pageParams(values url.Values) (page int, size int, err error) {
+	if values.Get("page") == "" {
+		return
+	}
+	if page, err = strconv.Atoi(values.Get("page")); err != nil || page < 1 {
+		err = errors.New(fmt.Sprintf("Invalid page %q", values.Get("page")))
+		return
+	}
+	size = DefaultPageSize
+	if s := values.Get("pagesize"); s != "" {
+		if size, err = strconv.Atoi(s); err != nil || size < 1 {
+			err = errors.New(fmt.Sprintf("Invalid page size %q", s))
+		}
+	}
+	return
+}
+
+// ProcessResults applies the descending sort order and paging parameters
+// of a transaction query. grumble queries cannot be limited or offset and
+// sort in ascending order only, so the full result is fetched and reversed
+// or cut into pages here. Invalid search parameters, for which ManyQuery
+// returns no transactions, are reported as errors.
+func (tx *Transaction) ProcessResults(results [][]grumble.Persistable, values url.Values) (ret [][]grumble.Persistable, err error) {
+	ret = results
+	if err = checkSearchParams(values); err != nil {
+		return
+	}
+	if _, descending := sortColumn(values); descending {
+		for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+			ret[i], ret[j] = ret[j], ret[i]
+		}
+	}
+	page, size, err := pageParams(values)
+	if err != nil || page == 0 {
+		return
+	}
+	start := (page - 1) * size
+	switch {
+	case start >= len(ret):
+		ret = ret[:0]
+	case start+size < len(ret):
+		ret = ret[start : start+size]
+	default:
+		ret = ret[start:]
+	}
+	return
+}
@@ -18,7 +18,7 @@
  */
 
 import React from 'react';
-import { DateFormat, Money, DisplayReference, TransactionList } from "../javascript/main";
+import { DateFormat, Money, DisplayReference, TransactionSearch } from "../javascript/main";
 
 export class AccountView extends React.Component {
     constructor(props) {
@@ -103,7 +103,7 @@ export class AccountsList extends React.Component {
 
     getRows() {
         return this.state.acclist.map((acc) => {
-            this.totalBalance += acc.CurrentBalance;
+            this.totalBalance += Number(acc.CurrentBalance);
             return <AccountRow key={acc[0].Ident} value={acc[0]} parent={acc[1]}/>
         });
     }
@@ -137,16 +137,25 @@ export class AccountsList extends React.Component {
 export function AccountBlock(props) {
     const accountid = props.id;
     const uploadUrl = `/account/upload/${accountid}`;
+    const previewUrl = `/account/preview/${accountid}`;
+    const reconcileUrl = `/account/reconcile/${accountid}`;
     return (
         <div>
             <AccountView accountid={accountid}/>
             <h2>Transactions</h2>
-            <TransactionList accountid={accountid}/>
+            <TransactionSearch accountid={accountid}/>
             <h2>Import Transactions</h2>
             <form encType="multipart/form-data" action={uploadUrl} method="post">
-                <input type="file" name="schema"/>
+                <input type="file" name="csv"/>
+                <input type="submit" value="preview" formAction={previewUrl}/>
                 <input type="submit" value="upload"/>
             </form>
+            <h2>Reconcile</h2>
+            <form action={reconcileUrl} method="post">
+                Statement date <input type="date" name="date"/>
+                Closing balance <input type="text" name="balance"/>
+                <input type="submit" value="reconcile"/>
+            </form>
         </div>
     );
 }
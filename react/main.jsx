@@ -26,9 +26,10 @@ import { render } from 'react-dom';
 import { AccountBlock, AccountsListBlock } from "../javascript/account";
 import { CategoryBlock } from "../javascript/category";
 
+// Amounts are served as strings with two decimals, e.g. "-12.34".
 export function Money(props) {
-    const amt = props["value"]
-    if ((typeof(amt) === "undefined") || (amt === 0.0)) {
+    const amt = Number(props["value"])
+    if (isNaN(amt) || (amt === 0.0)) {
         return <span>&nbsp;</span>;
     } else {
         return <span>{amt.toFixed(2)}</span>;
@@ -87,6 +88,7 @@ export class TransactionRow extends React.Component {
                 <td><DisplayReference value={tx} reference="Contact"/></td>
                 <td><DisplayReference value={tx} reference="Category"/></td>
                 <td><DisplayReference value={tx} reference="Project"/></td>
+                <td><Money value={tx.Balance}/></td>
             </tr>
         );
     }
@@ -118,7 +120,7 @@ export class TransactionList extends React.Component {
                     <td colSpan="3">T O T A L</td>
                     <td><Money value={this.totalCredit}/></td>
                     <td><Money value={this.totalDebit}/></td>
-                    <td colSpan="3">&nbsp;</td>
+                    <td colSpan="4">&nbsp;</td>
                 </tr>
             );
     }
@@ -126,8 +128,8 @@ export class TransactionList extends React.Component {
     getRows() {
         return this.state.txlist.map((tx) => {
             tx = tx[0];
-            this.totalDebit += tx.Debit;
-            this.totalCredit += tx.Credit;
+            this.totalDebit += Number(tx.Debit);
+            this.totalCredit += Number(tx.Credit);
             return <TransactionRow key={tx.Ident} value={tx}/>
         });
     }
@@ -146,6 +148,7 @@ export class TransactionList extends React.Component {
                         <th>Contact</th>
                         <th>Category</th>
                         <th>Project</th>
+                        <th>Balance</th>
                     </tr>
                 </thead>
                 <tbody>
@@ -159,6 +162,69 @@ export class TransactionList extends React.Component {
     }
 }
 
+// TransactionSearch shows a search form above a TransactionList. Its props
+// are passed on to the list, so they can restrict the search to e.g. one
+// account.
+export class TransactionSearch extends React.Component {
+    constructor(props) {
+        super(props);
+        this.state = { description: "", minamt: "", maxamt: "", from: "", to: "",
+            uncategorized: false, sort: "date", query: {} };
+        this.handleChange = this.handleChange.bind(this);
+        this.handleSubmit = this.handleSubmit.bind(this);
+    }
+
+    handleChange(event) {
+        const target = event.target;
+        this.setState({ [target.name]: (target.type === "checkbox") ? target.checked : target.value });
+    }
+
+    handleSubmit(event) {
+        event.preventDefault();
+        const query = { sort: this.state.sort };
+        for (const k of ["description", "minamt", "maxamt", "from", "to"]) {
+            if (this.state[k] !== "") {
+                query[k] = this.state[k];
+            }
+        }
+        if (this.state.uncategorized) {
+            query.uncategorized = "true";
+        }
+        this.setState({ query: query });
+    }
+
+    render() {
+        const query = Object.assign({}, this.props, this.state.query);
+        return (
+            <div>
+                <form onSubmit={this.handleSubmit}>
+                    <input type="text" name="description" placeholder="Description"
+                           value={this.state.description} onChange={this.handleChange}/>
+                    <input type="text" name="minamt" placeholder="Min. amount" size="8"
+                           value={this.state.minamt} onChange={this.handleChange}/>
+                    <input type="text" name="maxamt" placeholder="Max. amount" size="8"
+                           value={this.state.maxamt} onChange={this.handleChange}/>
+                    <input type="date" name="from" value={this.state.from} onChange={this.handleChange}/>
+                    <input type="date" name="to" value={this.state.to} onChange={this.handleChange}/>
+                    <label>
+                        <input type="checkbox" name="uncategorized"
+                               checked={this.state.uncategorized} onChange={this.handleChange}/>
+                        Uncategorized
+                    </label>
+                    <select name="sort" value={this.state.sort} onChange={this.handleChange}>
+                        <option value="date">Oldest first</option>
+                        <option value="-date">Newest first</option>
+                        <option value="amt">Amount</option>
+                        <option value="description">Description</option>
+                    </select>
+                    <input type="submit" value="Search"/>
+                </form>
+                <TransactionList key={JSON.stringify(query)} {...query}/>
+            </div>
+        );
+    }
+}
+
 export class Topbar extends React.Component {
     constructor(props) {
         super(props);
@@ -0,0 +1,108 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/finn/model"
+	"strings"
+	"unicode"
+)
+
+// AmountParser parses amounts as they appear in bank exports, e.g.
+// "$1,234.56", "(45.00)", "45.00-" or, with Decimal set to ",", "1.234,56".
+// Currency symbols and codes are ignored. If Negate is set, the sign of the
+// amount is flipped, for banks which report debits as positive amounts.
+type AmountParser struct {
+	Thousands string
+	Decimal   string
+	Negate    bool
+}
+
+// MakeAmountParser creates an AmountParser from the "thousands", "decimal"
+// and "negate" options of an import field. If only the decimal separator is
+// given and it is a comma, the thousands separator defaults to a period.
+func MakeAmountParser(options map[string]interface{}) (parser *AmountParser) {
+	parser = &AmountParser{Thousands: ",", Decimal: "."}
+	if d, ok := options["decimal"].(string); ok && d != "" {
+		parser.Decimal = d
+		if d == "," {
+			parser.Thousands = "."
+		}
+	}
+	if t, ok := options["thousands"].(string); ok {
+		parser.Thousands = t
+	}
+	if n, ok := options["negate"].(bool); ok {
+		parser.Negate = n
+	}
+	return
+}
+
+var defaultAmountParser = MakeAmountParser(nil)
+
+// ParseAmount parses an amount using a comma as the thousands separator and
+// a period as the decimal separator.
+func ParseAmount(s string) (model.Money, error) {
+	return defaultAmountParser.Parse(s)
+}
+
+func (parser *AmountParser) Parse(s string) (amt model.Money, err error) {
+	str := strings.TrimSpace(s)
+	negative := false
+	if strings.HasPrefix(str, "(") && strings.HasSuffix(str, ")") {
+		negative = true
+		str = str[1 : len(str)-1]
+	}
+	if strings.HasSuffix(str, "-") {
+		negative = !negative
+		str = str[:len(str)-1]
+	}
+	if parser.Thousands != "" {
+		str = strings.Replace(str, parser.Thousands, "", -1)
+	}
+	str = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsDigit(r), r == '-', r == '+':
+			return r
+		case strings.ContainsRune(parser.Decimal, r):
+			return '.'
+		case unicode.IsSpace(r), unicode.IsLetter(r), unicode.Is(unicode.Sc, r):
+			return -1
+		}
+		return r
+	}, str)
+	if str == "" {
+		err = errors.New(fmt.Sprintf("Could not parse amount %q", s))
+		return
+	}
+	if amt, err = model.ParseMoney(str); err != nil {
+		err = errors.New(fmt.Sprintf("Could not parse amount %q", s))
+		return
+	}
+	if negative {
+		amt = -amt
+	}
+	if parser.Negate {
+		amt = -amt
+	}
+	return
+}
@@ -0,0 +1,299 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/finn/render"
+	"github.com/JanDeVisser/grumble"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// UnmatchedGroup is a group of transactions which did not match any
+// template, with a regular expression which would match them.
+type UnmatchedGroup struct {
+	Key          string
+	Count        int
+	Descriptions []string
+	Suggestion   string
+}
+
+// TemplateCoverage counts how often a template matched, and how often it
+// set at least one field. A template which matches but never sets anything
+// is shadowed by the earlier templates which already set its fields, or by
+// an earlier matching template with stop set. Untested counts the
+// transactions the template could not be checked against, because it tests
+// fields which were not stored with them.
+type TemplateCoverage struct {
+	Template   string
+	Priority   int
+	Matches    int
+	Hits       int
+	Untested   int
+	ShadowedBy string
+	shadowedBy map[int]int
+}
+
+// CoverageReport shows how well the templates of an account's import
+// profile cover its transactions, or the transactions of one import.
+type CoverageReport struct {
+	Account   *model.Account
+	Import    *TXImport
+	Lines     int
+	Matched   int
+	Unmatched []*UnmatchedGroup
+	Templates []*TemplateCoverage
+	groups    map[string]*UnmatchedGroup
+}
+
+var digits = regexp.MustCompile("[0-9]")
+
+// unmatchedKey groups descriptions by their leading words, up to the first
+// word containing a digit, since those are usually store numbers, dates or
+// reference numbers.
+func unmatchedKey(description string) string {
+	words := strings.Fields(description)
+	key := make([]string, 0, len(words))
+	for _, word := range words {
+		if digits.MatchString(word) {
+			break
+		}
+		key = append(key, word)
+	}
+	if len(key) == 0 && len(words) > 0 {
+		key = append(key, strings.TrimRightFunc(words[0], unicode.IsDigit))
+	}
+	return strings.Join(key, " ")
+}
+
+func MakeCoverageReport(account *model.Account, txImport *TXImport) (report *CoverageReport, err error) {
+	imp := &CSVImporter{Account: account}
+	if err = imp.parseTemplate(); err != nil {
+		return
+	}
+	report = &CoverageReport{Account: account, Import: txImport}
+	report.groups = make(map[string]*UnmatchedGroup)
+	report.Templates = make([]*TemplateCoverage, len(imp.Templates))
+	for ix := range imp.Templates {
+		report.Templates[ix] = &TemplateCoverage{
+			Template:   imp.Templates[ix].String(),
+			Priority:   imp.Templates[ix].Priority,
+			shadowedBy: make(map[int]int),
+		}
+	}
+
+	var txs []*model.Transaction
+	var imports []*TXImport
+	if txImport != nil {
+		imports = []*TXImport{txImport}
+		var entities []grumble.Persistable
+		if entities, err = model.GetImportedTransactions(account.Manager(), txImport.Id()); err != nil {
+			return
+		}
+		for _, e := range entities {
+			if tx := model.TransactionOf(e); tx != nil {
+				txs = append(txs, tx)
+			}
+		}
+	} else {
+		if txs, err = account.GetTransactions(); err != nil {
+			return
+		}
+		if imports, err = GetImports(account); err != nil {
+			return
+		}
+	}
+	stored := makeStoredFields(imp, imports)
+	for _, tx := range txs {
+		if tx != nil && tx.TXType != model.OpeningBalance {
+			report.add(imp, stored, tx)
+		}
+	}
+	report.finish()
+	return
+}
+
+func (report *CoverageReport) add(imp *CSVImporter, stored *storedFields, tx *model.Transaction) {
+	report.Lines++
+	fields, untestable := stored.fields(tx)
+	for ix := range untestable {
+		report.Templates[ix].Untested++
+	}
+	first, stop := -1, -1
+	imp.applyTemplates(fields, tx.Amt, func(ix int, effective bool) {
+		coverage := report.Templates[ix]
+		coverage.Matches++
+		switch {
+		case stop >= 0:
+			coverage.shadowedBy[stop]++
+		case first < 0:
+			first = ix
+			coverage.Hits++
+		case effective:
+			coverage.Hits++
+		default:
+			coverage.shadowedBy[first]++
+		}
+		if stop < 0 && imp.Templates[ix].Stop {
+			stop = ix
+		}
+	})
+	if first >= 0 {
+		report.Matched++
+		return
+	}
+	key := unmatchedKey(tx.Description)
+	group, ok := report.groups[key]
+	if !ok {
+		group = &UnmatchedGroup{Key: key, Descriptions: make([]string, 0)}
+		if key != "" {
+			group.Suggestion = "^" + regexp.QuoteMeta(key)
+		}
+		report.groups[key] = group
+	}
+	group.Count++
+	if len(group.Descriptions) < 3 {
+		for _, d := range group.Descriptions {
+			if d == tx.Description {
+				return
+			}
+		}
+		group.Descriptions = append(group.Descriptions, tx.Description)
+	}
+}
+
+func (report *CoverageReport) finish() {
+	report.Unmatched = make([]*UnmatchedGroup, 0, len(report.groups))
+	for _, group := range report.groups {
+		report.Unmatched = append(report.Unmatched, group)
+	}
+	sort.Slice(report.Unmatched, func(i, j int) bool {
+		if report.Unmatched[i].Count != report.Unmatched[j].Count {
+			return report.Unmatched[i].Count > report.Unmatched[j].Count
+		}
+		return report.Unmatched[i].Key < report.Unmatched[j].Key
+	})
+	for _, coverage := range report.Templates {
+		max, shadow := 0, -1
+		for ix, count := range coverage.shadowedBy {
+			if count > max || (count == max && ix < shadow) {
+				max, shadow = count, ix
+			}
+		}
+		if shadow >= 0 {
+			coverage.ShadowedBy = report.Templates[shadow].Template
+		}
+	}
+}
+
+// Unused returns the templates which did not match any transaction they
+// could be checked against.
+func (report *CoverageReport) Unused() (ret []*TemplateCoverage) {
+	for _, coverage := range report.Templates {
+		if coverage.Matches == 0 && coverage.Untested == 0 {
+			ret = append(ret, coverage)
+		}
+	}
+	return
+}
+
+// Unchecked returns the templates which could not be checked against some
+// of the transactions.
+func (report *CoverageReport) Unchecked() (ret []*TemplateCoverage) {
+	for _, coverage := range report.Templates {
+		if coverage.Untested > 0 {
+			ret = append(ret, coverage)
+		}
+	}
+	return
+}
+
+// Shadowed returns the templates which matched transactions but never set
+// a field because earlier templates already did.
+func (report *CoverageReport) Shadowed() (ret []*TemplateCoverage) {
+	for _, coverage := range report.Templates {
+		if coverage.Matches > 0 && coverage.Hits == 0 {
+			ret = append(ret, coverage)
+		}
+	}
+	return
+}
+
+func renderCoverage(w http.ResponseWriter, account *model.Account, txImport *TXImport) {
+	report, err := MakeCoverageReport(account, txImport)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx := make(map[string]interface{})
+	ctx["Report"] = report
+	render.RenderTemplate(w, "coverage", ctx)
+}
+
+// AccountCoverage shows the template coverage report for all transactions
+// of an account.
+func AccountCoverage(w http.ResponseWriter, r *http.Request) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := model.PathId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	account, err := model.GetAccount(mgr, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderCoverage(w, account, nil)
+}
+
+// ImportCoverage shows the template coverage report for the transactions
+// of one import.
+func ImportCoverage(w http.ResponseWriter, r *http.Request) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := model.PathId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	imp, err := GetImport(mgr, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	account, err := model.GetAccount(mgr, imp.Parent().Id())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderCoverage(w, account, imp)
+}
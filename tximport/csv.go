@@ -1,18 +1,19 @@
 package tximport
 
 import (
+	"crypto/sha1"
 	"database/sql"
 	"encoding/csv"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/JanDeVisser/finn/model"
 	"github.com/JanDeVisser/grumble"
 	"io"
 	"io/ioutil"
-	"path/filepath"
+	"log"
 	"reflect"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +23,13 @@ type Importer interface {
 	Process(*TXImport) error
 }
 
+// LineImporter is implemented by importers which can process selected lines
+// of the import data. This is used to re-run lines which failed to import.
+type LineImporter interface {
+	Importer
+	ProcessLines(*TXImport, map[int]bool) error
+}
+
 type ImporterFactory func(*model.Account) (Importer, error)
 
 func setValueInObject(obj interface{}, name string, value interface{}) {
@@ -63,6 +71,7 @@ const (
 	Completed                = "Completed"
 	ImportError              = "Error"
 	Partial                  = "Partial"
+	Undone                   = "Undone"
 )
 
 type TXImport struct {
@@ -74,23 +83,37 @@ type TXImport struct {
 	Total     int
 	Good      int
 	Bad       int
+	Skipped   int
 	Errors    string
 	importer  Importer
+	account   *model.Account
+	preview   *ImportPreview
 }
 
-func (imp *TXImport) FindOrCreate(kind interface{}, field string, value string) (e grumble.Persistable, err error) {
-	e, err = imp.Manager().By(grumble.GetKind(kind), field, value)
+// findOrCreate returns the entity of the given kind with the field set to
+// value, creating it if it does not exist yet.
+func findOrCreate(mgr *grumble.EntityManager, kind interface{}, field string, value string) (e grumble.Persistable, created bool, err error) {
+	e, err = mgr.By(grumble.GetKind(kind), field, value)
 	if err != nil {
 		err = errors.New(fmt.Sprintf("By(%q = %q): %s", field, value, err))
 		return
 	}
 	if e == nil {
-		e, err = imp.Manager().Make(grumble.GetKind(kind), nil, 0)
+		e, err = mgr.Make(grumble.GetKind(kind), nil, 0)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		setValueInObject(e, field, value)
-		err = imp.Manager().Put(e)
+		err = mgr.Put(e)
+		created = err == nil
+	}
+	return
+}
+
+func (imp *TXImport) FindOrCreate(kind interface{}, field string, value string) (e grumble.Persistable, err error) {
+	e, created, err := findOrCreate(imp.Manager(), kind, field, value)
+	if created && imp.preview != nil {
+		imp.preview.AddCreated(grumble.GetKind(kind).Kind, value)
 	}
 	return
 }
@@ -117,6 +140,41 @@ func (imp *TXImport) AddError(err error) {
 	}
 }
 
+// ErrDuplicate is returned by importers for lines that were imported
+// before. These lines are counted as skipped, not as errors.
+var ErrDuplicate = errors.New("Duplicate")
+
+// Reset clears the line counters. Importers call this before processing
+// the import data.
+func (imp *TXImport) Reset() {
+	imp.Total = 0
+	imp.Good = 0
+	imp.Bad = 0
+	imp.Skipped = 0
+}
+
+// Tally counts a processed line using the error returned when booking it.
+// For failed lines the error is added to Errors, and an ImportLineError
+// holding the line number and the raw fields of the line is stored.
+func (imp *TXImport) Tally(line int, raw []string, err error) {
+	imp.Total++
+	if imp.preview != nil {
+		imp.preview.Tally(line, err)
+	}
+	switch {
+	case err == nil:
+		imp.Good++
+	case err == ErrDuplicate:
+		imp.Skipped++
+	default:
+		imp.Bad++
+		imp.AddError(errors.New(fmt.Sprintf("Line %d: %s", line, err)))
+		if e := imp.AddLineError(line, raw, err); e != nil {
+			imp.AddError(e)
+		}
+	}
+}
+
 func (imp *TXImport) Update(status ImportStatus, err error) {
 	if err != nil {
 		imp.AddError(err)
@@ -133,6 +191,14 @@ func (imp *TXImport) Read() (err error) {
 		err = imp.importer.Process(imp)
 		return
 	})
+	imp.finish(err)
+	if err == nil && imp.Good > 0 && imp.preview == nil {
+		imp.matchTransfers()
+	}
+	return
+}
+
+func (imp *TXImport) finish(err error) {
 	switch {
 	case err != nil:
 		imp.Update(ImportError, err)
@@ -143,7 +209,15 @@ func (imp *TXImport) Read() (err error) {
 	default:
 		imp.Update(Completed, nil)
 	}
-	return
+}
+
+func (imp *TXImport) matchTransfers() {
+	match := MakeTransferMatch(imp.account, DefaultMatchWindow)
+	if err := match.Run(imp.Manager()); err != nil {
+		log.Printf("Matching transfers for import %q failed: %s", imp.FileName, err)
+		return
+	}
+	log.Printf("Import %q: %s", imp.FileName, match)
 }
 
 func MakeTXImport(account *model.Account, fileName string) (imp *TXImport, err error) {
@@ -152,6 +226,7 @@ func MakeTXImport(account *model.Account, fileName string) (imp *TXImport, err e
 		Timestamp: time.Now(),
 	}
 	imp.Initialize(account, 0)
+	imp.account = account
 	var data []byte
 	var status ImportStatus
 	//if data, err = ioutil.ReadFile(filepath.Join("data", account.AccName, fileName)); err != nil {
@@ -169,11 +244,32 @@ func MakeTXImport(account *model.Account, fileName string) (imp *TXImport, err e
 	return
 }
 
+// ImportField maps a column of an import file to a transaction field. Date
+// fields take a "format" option, which is a strftime style format or a list
+// of them, an optional "timeformat" for the time column, and a "timezone"
+// option overriding the one in the importer's config. If the file has
+// columns mapped as "time" and "timezone", they are combined with the date.
+// Money fields, which can also be declared as "float", are parsed exactly
+// and take the "thousands", "decimal" and "negate" options of AmountParser.
+// Files with separate debit and credit columns can map them as "debit" and
+// "credit"; they are combined into a single signed amount.
 type ImportField struct {
 	Name    string
 	Num     int
 	Type    string
 	Options map[string]interface{}
+	dates   *DateParser
+	amounts *AmountParser
+}
+
+// initDates sets up the date parser of a date field. zone is the default
+// time zone of the importer.
+func (fld *ImportField) initDates(zone string) (err error) {
+	if z, ok := fld.Options["timezone"].(string); ok {
+		zone = z
+	}
+	fld.dates, err = MakeDateParser(fld.Options["format"], fld.Options["timeformat"], zone)
+	return
 }
 
 func (fld *ImportField) Convert(str string) (ret interface{}, err error) {
@@ -187,38 +283,28 @@ func (fld *ImportField) Convert(str string) (ret interface{}, err error) {
 			return
 		}
 		ret = int(i64)
-	case "float":
-		ret, err = strconv.ParseFloat(str, 0)
+	case "money", "float":
+		if fld.amounts == nil {
+			fld.amounts = MakeAmountParser(fld.Options)
+		}
+		ret, err = fld.amounts.Parse(str)
 	case "bool":
 		ret, err = strconv.ParseBool(str)
 	case "date":
-		layout := "01/02/2006"
-		l, ok := fld.Options["format"]
-		if ok {
-			if layout, ok = l.(string); !ok {
-				layout = "01/02/2006"
-			}
-		}
-		ret, err = time.Parse(layout, str)
+		ret, err = fld.ConvertDate(str, "", "")
 	}
 	return
 }
 
-type Template struct {
-	Template string
-	MatchOn  string
-	Type     string
-	Contact  string
-	Category string
-	Project  string
-	re       *regexp.Regexp
-}
-
-func MakeTemplate(def map[string]interface{}) (ret Template, err error) {
-	ret = Template{MatchOn: "description"}
-	setValuesInObject(&ret, def, nil)
-	ret.re, err = regexp.Compile(ret.Template)
-	return
+// ConvertDate parses a date, combined with the time of day and time zone if
+// they are not empty.
+func (fld *ImportField) ConvertDate(date string, tod string, zone string) (t time.Time, err error) {
+	if fld.dates == nil {
+		if err = fld.initDates(""); err != nil {
+			return
+		}
+	}
+	return fld.dates.Parse(date, tod, zone)
 }
 
 type CSVImporter struct {
@@ -227,25 +313,28 @@ type CSVImporter struct {
 	Templates  []Template
 	Config     map[string]interface{}
 	HeaderLine bool
+
+	fingerprints map[string]int
 }
 
 func (imp *CSVImporter) parseTemplate() (err error) {
-	fileName := filepath.Join("data", imp.Account.AccName+".json")
-	var jsonText []byte
-	if jsonText, err = ioutil.ReadFile(fileName); err != nil {
-		return
-	}
-	var jsonData interface{}
-	err = json.Unmarshal(jsonText, &jsonData)
+	data, err := loadProfileData(imp.Account)
 	if err != nil {
 		return
 	}
-	data := jsonData.(map[string]interface{})
+	return imp.parseProfile(data)
+}
 
+// parseProfile sets up the importer from an import profile, an object with
+// "mapping", "config" and "templates" members.
+func (imp *CSVImporter) parseProfile(data map[string]interface{}) (err error) {
 	mappings := make([]*ImportField, 0)
 	m, ok := data["mapping"]
 	if ok {
-		mapping := m.([]interface{})
+		mapping, ok := m.([]interface{})
+		if !ok {
+			return errors.New("Profile mapping must be a list")
+		}
 		for ix, f := range mapping {
 			importField := &ImportField{Num: ix, Options: make(map[string]interface{})}
 			switch col := f.(type) {
@@ -257,6 +346,8 @@ func (imp *CSVImporter) parseTemplate() (err error) {
 			case map[string]interface{}:
 				setValuesInObject(importField, col, importField.Options)
 				importField.Name = strings.ToLower(importField.Name)
+			default:
+				return errors.New(fmt.Sprintf("Invalid mapping for column %d", ix))
 			}
 			mappings = append(mappings, importField)
 		}
@@ -270,16 +361,33 @@ func (imp *CSVImporter) parseTemplate() (err error) {
 	imp.Config = make(map[string]interface{})
 	c, ok := data["config"]
 	if ok {
-		config := c.(map[string]interface{})
+		config, ok := c.(map[string]interface{})
+		if !ok {
+			return errors.New("Profile config must be an object")
+		}
 		setValuesInObject(imp, config, imp.Config)
 	}
+	zone, _ := imp.Config["timezone"].(string)
+	for _, mapping := range imp.Mappings {
+		if mapping.Type == "date" {
+			if err = mapping.initDates(zone); err != nil {
+				return
+			}
+		}
+	}
 
 	imp.Templates = make([]Template, 0)
 	t, ok := data["templates"]
 	if ok {
-		templates := t.([]interface{})
+		templates, ok := t.([]interface{})
+		if !ok {
+			return errors.New("Profile templates must be a list")
+		}
 		for _, t := range templates {
-			tpl := t.(map[string]interface{})
+			tpl, ok := t.(map[string]interface{})
+			if !ok {
+				return errors.New("Profile templates must be objects")
+			}
 			var template Template
 			template, err = MakeTemplate(tpl)
 			if err != nil {
@@ -288,28 +396,40 @@ func (imp *CSVImporter) parseTemplate() (err error) {
 			imp.Templates = append(imp.Templates, template)
 		}
 	}
+	sort.SliceStable(imp.Templates, func(i, j int) bool {
+		return imp.Templates[i].Priority > imp.Templates[j].Priority
+	})
 	return
 }
 
 func (imp *CSVImporter) Process(txImport *TXImport) (err error) {
+	txImport.Reset()
+	return imp.ProcessLines(txImport, nil)
+}
+
+// ProcessLines imports the lines with the given line numbers, or all lines
+// if lines is nil. Line numbers start at 1 and include the header line.
+// Lines which are not imported are still counted for fingerprinting.
+func (imp *CSVImporter) ProcessLines(txImport *TXImport, lines map[int]bool) (err error) {
 	rdr := csv.NewReader(strings.NewReader(txImport.Data))
+	num := 0
 	if imp.HeaderLine {
 		if _, err = rdr.Read(); err != nil {
 			return
 		}
+		num++
 	}
 	var e error
-	txImport.Good = 0
-	txImport.Bad = 0
-	txImport.Total = 0
+	imp.fingerprints = make(map[string]int)
 	for record, e := rdr.Read(); e == nil; record, e = rdr.Read() {
-		txImport.Total++
-		if err = imp.ProcessLine(record, txImport); err != nil {
-			txImport.Bad++
-			txImport.AddError(err)
-		} else {
-			txImport.Good++
+		num++
+		if lines != nil && !lines[num] {
+			if tx, e := imp.buildTransaction(imp.fields(record)); e == nil {
+				imp.ordinal(transaction(tx))
+			}
+			continue
 		}
+		txImport.Tally(num, record, imp.ProcessLine(record, txImport))
 	}
 	if e != io.EOF {
 		err = e
@@ -317,8 +437,37 @@ func (imp *CSVImporter) Process(txImport *TXImport) (err error) {
 	return
 }
 
-func (imp *CSVImporter) ProcessLine(line []string, txImport *TXImport) (err error) {
-	fields := make(map[string]string)
+// lineFields returns the fields of the lines of an import, keyed by the
+// fingerprint of the transaction each line was imported as. Templates can
+// then be re-applied to stored transactions with all the columns of the
+// line they came from.
+func (imp *CSVImporter) lineFields(txImport *TXImport) (lines map[string]map[string]string, err error) {
+	lines = make(map[string]map[string]string)
+	rdr := csv.NewReader(strings.NewReader(txImport.Data))
+	if imp.HeaderLine {
+		if _, err = rdr.Read(); err != nil {
+			return
+		}
+	}
+	imp.fingerprints = make(map[string]int)
+	var record []string
+	for record, err = rdr.Read(); err == nil; record, err = rdr.Read() {
+		fields := imp.fields(record)
+		tx, e := imp.buildTransaction(fields)
+		if e != nil {
+			continue
+		}
+		sum := sha1.Sum([]byte(imp.ordinal(transaction(tx))))
+		lines[hex.EncodeToString(sum[:])] = fields
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+func (imp *CSVImporter) fields(line []string) (fields map[string]string) {
+	fields = make(map[string]string)
 	for ix, f := range line {
 		if ix >= len(imp.Mappings) {
 			break
@@ -328,51 +477,136 @@ func (imp *CSVImporter) ProcessLine(line []string, txImport *TXImport) (err erro
 		}
 		fields[imp.Mappings[ix].Name] = f
 	}
-	imp.ApplyTemplates(fields)
+	return
+}
+
+func (imp *CSVImporter) ProcessLine(line []string, txImport *TXImport) (err error) {
+	fields := imp.fields(line)
+	imp.ApplyTemplates(fields, imp.lineAmount(fields))
 	err = imp.SaveTransaction(txImport, fields)
 	return
 }
 
-func (imp *CSVImporter) ApplyTemplates(fields map[string]string) {
-	for _, tmpl := range imp.Templates {
-		v, ok := fields[tmpl.MatchOn]
-		if !ok {
+func (imp *CSVImporter) buildTransaction(fields map[string]string) (tx grumble.Persistable, err error) {
+	txType := model.Debit
+	if t, ok := fields["type"]; ok {
+		txType = t
+	}
+	tx, err = imp.Account.MakeTransaction(txType)
+	if err != nil {
+		return
+	}
+	var amt model.Money
+	signed := false
+	for _, mapping := range imp.Mappings {
+		if mapping.Name == "" {
 			continue
 		}
-		if tmpl.re.MatchString(v) {
-			if tmpl.Type != "" {
-				fields["type"] = tmpl.Type
+		var val interface{}
+		if mapping.Name == "debit" || mapping.Name == "credit" {
+			if strings.TrimSpace(fields[mapping.Name]) == "" {
+				continue
 			}
-			if tmpl.Contact != "" {
-				fields["contact"] = tmpl.Contact
+			if val, err = mapping.Convert(fields[mapping.Name]); err != nil {
+				err = &FieldError{Column: mapping.Name, Err: err}
+				return
 			}
-			if tmpl.Category != "" {
-				fields["category"] = tmpl.Category
+			m, ok := val.(model.Money)
+			if !ok {
+				err = &FieldError{Column: mapping.Name, Err: errors.New("Debit and credit columns must have type money")}
+				return
 			}
-			if tmpl.Project != "" {
-				fields["project"] = tmpl.Project
+			if mapping.Name == "debit" {
+				amt -= m.Abs()
+			} else {
+				amt += m.Abs()
 			}
+			signed = true
+			continue
+		}
+		if mapping.Type == "date" {
+			val, err = mapping.ConvertDate(fields[mapping.Name], fields["time"], fields["timezone"])
+		} else {
+			val, err = mapping.Convert(fields[mapping.Name])
 		}
+		if err != nil {
+			err = &FieldError{Column: mapping.Name, Err: err}
+			return
+		}
+		setValueInObject(tx, mapping.Name, val)
 	}
+	if signed {
+		setValueInObject(tx, "amt", amt)
+	}
+	return
 }
 
 func (imp *CSVImporter) SaveTransaction(txImport *TXImport, fields map[string]string) (err error) {
-	txType := model.Debit
-	if t, ok := fields["type"]; ok {
-		txType = t
-	}
 	var tx grumble.Persistable
-	tx, err = imp.Account.MakeTransaction(txType)
-	if err != nil {
+	if tx, err = imp.buildTransaction(fields); err != nil {
 		return
 	}
-	for _, mapping := range imp.Mappings {
-		var val interface{}
-		val, err = mapping.Convert(fields[mapping.Name])
-		if err != nil {
+	if err = imp.checkDuplicate(txImport, tx, fields); err != nil {
+		return
+	}
+	err = imp.Save(txImport, tx, fields)
+	return
+}
+
+// Fingerprint identifies a CSV line by its date, amount and description, so
+// that lines from overlapping statements are only imported once. Identical
+// lines on the same day are told apart by their ordinal in the file. The
+// fingerprint is stored as the ExternalId of the transaction. If the account
+// already holds a transaction with this fingerprint, ErrDuplicate is
+// returned.
+func (imp *CSVImporter) Fingerprint(txp grumble.Persistable) (err error) {
+	tx := transaction(txp)
+	if tx == nil {
+		return
+	}
+	sum := sha1.Sum([]byte(imp.ordinal(tx)))
+	tx.ExternalId = hex.EncodeToString(sum[:])
+	var exists bool
+	if exists, err = imp.Account.HasTransaction(tx.ExternalId); err == nil && exists {
+		err = ErrDuplicate
+	}
+	return
+}
+
+// checkDuplicate calls Fingerprint. Duplicates are recorded in the preview,
+// if there is one, so that it shows the lines which are skipped.
+func (imp *CSVImporter) checkDuplicate(txImport *TXImport, txp grumble.Persistable, fields map[string]string) (err error) {
+	if err = imp.Fingerprint(txp); err == ErrDuplicate && txImport.preview != nil {
+		txImport.preview.Record(txp, fields)
+	}
+	return
+}
+
+// ordinal counts the occurrences of the date, amount and description of the
+// transaction, and returns these values together with the count.
+func (imp *CSVImporter) ordinal(tx *model.Transaction) string {
+	if tx == nil {
+		return ""
+	}
+	line := fmt.Sprintf("%s|%.2f|%s", tx.Date.Format("2006-01-02"), tx.Amt, tx.Description)
+	if imp.fingerprints == nil {
+		imp.fingerprints = make(map[string]int)
+	}
+	imp.fingerprints[line]++
+	return fmt.Sprintf("%s|%d", line, imp.fingerprints[line])
+}
+
+// Save resolves the contact, project and category names in fields, and
+// stores the transaction. Transfers are booked against their counter account.
+func (imp *CSVImporter) Save(txImport *TXImport, tx grumble.Persistable, fields map[string]string) (err error) {
+	if t := transaction(tx); t != nil {
+		t.ImportId = txImport.Id()
+		if err = imp.convertCurrency(t); err != nil {
 			return
 		}
-		setValueInObject(tx, mapping.Name, val)
+	}
+	if txImport.preview != nil {
+		txImport.preview.Record(tx, fields)
 	}
 	if err = txImport.SetReference(tx, "Contact", model.Contact{}, fields["contact"]); err != nil {
 		return
@@ -383,12 +617,54 @@ func (imp *CSVImporter) SaveTransaction(txImport *TXImport, fields map[string]st
 	if err = txImport.SetReference(tx, "Category", model.Category{}, fields["category"]); err != nil {
 		return
 	}
+	if transfer, ok := tx.(*model.TransferTx); ok {
+		err = imp.Transfer(transfer, fields["counter"])
+		return
+	}
 	if err = tx.Manager().Put(tx); err != nil {
 		return
 	}
 	return
 }
 
+// convertCurrency books a transaction in a foreign currency for its value in
+// the account currency, using the exchange rate on the transaction date. The
+// amount read from the file is kept in ForeignAmt. Transactions for which
+// the importer already filled in ForeignAmt are left alone.
+func (imp *CSVImporter) convertCurrency(tx *model.Transaction) (err error) {
+	tx.Currency = strings.ToUpper(strings.TrimSpace(tx.Currency))
+	currency := imp.Account.CurrencyCode()
+	if tx.Currency == "" || tx.Currency == currency || tx.ForeignAmt != 0 {
+		return
+	}
+	var amt model.Money
+	if amt, err = model.ConvertMoney(imp.Account.Manager(), tx.Amt, tx.Currency, currency, tx.Date); err != nil {
+		return
+	}
+	tx.ForeignAmt = tx.Amt
+	tx.Amt = amt
+	return
+}
+
+// Transfer books a transfer transaction against the account named by
+// counter. If the matching template did not specify a counter account, the
+// "counter" entry of the profile's config is used.
+func (imp *CSVImporter) Transfer(tx *model.TransferTx, counter string) (err error) {
+	if counter == "" {
+		if c, ok := imp.Config["counter"].(string); ok {
+			counter = c
+		}
+	}
+	if counter == "" {
+		return errors.New(fmt.Sprintf("Transfer %q has no counter account", tx.Description))
+	}
+	var counterAccount *model.Account
+	if counterAccount, err = model.GetAccountByName(imp.Account.Manager(), counter); err != nil {
+		return
+	}
+	return imp.Account.Transfer(tx, counterAccount)
+}
+
 func MakeCSVImporter(account *model.Account) (ret Importer, err error) {
 	imp := &CSVImporter{}
 	imp.Account = account
@@ -402,12 +678,15 @@ var importers = make(map[string]ImporterFactory)
 
 func GetImporter(account *model.Account) (ret Importer, err error) {
 	factory, ok := importers[account.Importer]
-	if ok {
-		ret, err = factory(account)
+	if !ok {
+		err = errors.New(fmt.Sprintf("Account %q has unknown importer %q", account.AccName, account.Importer))
+		return
 	}
+	ret, err = factory(account)
 	return
 }
 
 func init() {
+	grumble.GetKind(&TXImport{})
 	importers["CSV"] = MakeCSVImporter
 }
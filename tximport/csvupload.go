@@ -20,14 +20,19 @@
 package tximport
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/finn/render"
 	"github.com/JanDeVisser/grumble"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
-	"strings"
+	"time"
 )
 
 type CSVUploader struct {
@@ -52,13 +57,10 @@ func MakeCSVUploader(w http.ResponseWriter, r *http.Request) (ret *CSVUploader)
 		return
 	}
 
-	idStr := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
-	id64, err := strconv.ParseInt(idStr, 0, 0)
-	if err != nil {
+	if ret.id, err = model.PathId(r); err != nil {
 		ret.ctx["error"] = err
 		return
 	}
-	ret.id = int(id64)
 	ret.account, err = model.GetAccount(ret.mgr, ret.id)
 	if err != nil {
 		ret.ctx["error"] = err
@@ -78,7 +80,9 @@ func (uploader *CSVUploader) SuccessRedirect() {
 		fmt.Sprintf("/account/%d", uploader.id), http.StatusSeeOther)
 }
 
-func (uploader *CSVUploader) Upload() {
+// receive stores the uploaded file in a temporary file named after the
+// given pattern, and returns the name of that file.
+func (uploader *CSVUploader) receive(pattern string) (fileName string) {
 	// Parse our multipart form, 10 << 20 specifies a maximum
 	// upload of 10 MB files.
 	err := uploader.r.ParseMultipartForm(10 << 20)
@@ -102,35 +106,39 @@ func (uploader *CSVUploader) Upload() {
 
 	// Create a temporary file within our temp-images directory that follows
 	// a particular naming pattern
-	tempFile, err := ioutil.TempFile("", "upload-*.csv")
+	tempFile, err := ioutil.TempFile("", pattern)
 	if err != nil {
 		uploader.ctx["error"] = err
 		return
 	}
-	defer func() {
-		_ = os.Remove(tempFile.Name())
-	}()
 
 	// read all of the contents of our uploaded file into a
 	// byte array
 	fileBytes, err := ioutil.ReadAll(file)
 	if err != nil {
 		uploader.ctx["error"] = err
+		_ = os.Remove(tempFile.Name())
 		return
 	}
 
 	// write this byte array to our temporary file
 	if written, err := tempFile.Write(fileBytes); err != nil || written != len(fileBytes) {
 		uploader.ctx["error"] = err
+		_ = os.Remove(tempFile.Name())
 		return
 	}
 	err = tempFile.Close()
 	if err != nil {
 		uploader.ctx["error"] = err
+		_ = os.Remove(tempFile.Name())
 		return
 	}
+	fileName = tempFile.Name()
+	return
+}
 
-	txImport, err := MakeTXImport(uploader.account, tempFile.Name())
+func (uploader *CSVUploader) importFile(fileName string) {
+	txImport, err := MakeTXImport(uploader.account, fileName)
 	if err != nil {
 		uploader.ctx["error"] = err
 		return
@@ -142,6 +150,78 @@ func (uploader *CSVUploader) Upload() {
 	}
 }
 
+func (uploader *CSVUploader) Upload() {
+	fileName := uploader.receive("upload-*.csv")
+	if fileName == "" {
+		return
+	}
+	defer func() {
+		_ = os.Remove(fileName)
+	}()
+	uploader.importFile(fileName)
+}
+
+// PreviewExpiry is how long an uploaded file is kept waiting for the
+// confirmation of its preview.
+var PreviewExpiry = 24 * time.Hour
+
+// ExpirePreviews removes the files of previews which were not confirmed
+// within PreviewExpiry.
+func ExpirePreviews() {
+	fileNames, err := filepath.Glob(filepath.Join(os.TempDir(), "preview-*.csv"))
+	if err != nil {
+		return
+	}
+	for _, fileName := range fileNames {
+		if !previewToken.MatchString(filepath.Base(fileName)) {
+			continue
+		}
+		if info, err := os.Stat(fileName); err == nil && time.Since(info.ModTime()) > PreviewExpiry {
+			_ = os.Remove(fileName)
+		}
+	}
+}
+
+// Preview stores the uploaded file and runs a trial import of it. The file
+// is kept until the import is confirmed, or until it expires; the token
+// identifying it is passed back to Confirm. Tokens carry the id of the
+// account, so that a file can only be imported into the account it was
+// previewed for.
+func (uploader *CSVUploader) Preview() {
+	ExpirePreviews()
+	fileName := uploader.receive(fmt.Sprintf("preview-%d-*.csv", uploader.id))
+	if fileName == "" {
+		return
+	}
+	preview, err := Preview(uploader.account, fileName)
+	if err != nil {
+		uploader.ctx["error"] = err
+		_ = os.Remove(fileName)
+		return
+	}
+	uploader.ctx["Preview"] = preview
+	uploader.ctx["Token"] = filepath.Base(fileName)
+}
+
+// Confirm imports a file previously uploaded for preview.
+func (uploader *CSVUploader) Confirm() {
+	token := uploader.r.FormValue("token")
+	match := previewToken.FindStringSubmatch(token)
+	if match == nil {
+		uploader.ctx["error"] = errors.New(fmt.Sprintf("Invalid preview token %q", token))
+		return
+	}
+	if match[1] != strconv.Itoa(uploader.id) {
+		uploader.ctx["error"] = errors.New(fmt.Sprintf("Preview %q is not for account %q", token, uploader.account.AccName))
+		return
+	}
+	fileName := filepath.Join(os.TempDir(), token)
+	defer func() {
+		_ = os.Remove(fileName)
+	}()
+	uploader.importFile(fileName)
+}
+
 func UploadCSV(w http.ResponseWriter, r *http.Request) {
 	uploader := MakeCSVUploader(w, r)
 	if _, ok := uploader.ctx["error"]; ok {
@@ -160,3 +240,62 @@ func UploadCSV(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// Tokens are the base names of files created by
+// receive("preview-<account id>-*.csv").
+var previewToken = regexp.MustCompile(`^preview-([0-9]+)-[0-9]+\.csv$`)
+
+func PreviewCSV(w http.ResponseWriter, r *http.Request) {
+	uploader := MakeCSVUploader(w, r)
+	if _, ok := uploader.ctx["error"]; ok {
+		uploader.ErrorRedirect()
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		uploader.SuccessRedirect()
+		return
+	}
+	uploader.Preview()
+	if r.URL.Query().Get("format") == "json" {
+		if e, ok := uploader.ctx["error"]; ok {
+			http.Error(w, e.(error).Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonText, err := json.Marshal(map[string]interface{}{
+			"token":   uploader.ctx["Token"],
+			"preview": uploader.ctx["Preview"],
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-type", "text/json")
+		_, _ = w.Write(jsonText)
+		return
+	}
+	if _, ok := uploader.ctx["error"]; ok {
+		uploader.ErrorRedirect()
+	} else {
+		render.RenderTemplate(w, "csvpreview", uploader.ctx)
+	}
+}
+
+func ConfirmCSV(w http.ResponseWriter, r *http.Request) {
+	uploader := MakeCSVUploader(w, r)
+	if _, ok := uploader.ctx["error"]; ok {
+		uploader.ErrorRedirect()
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		uploader.SuccessRedirect()
+	} else {
+		uploader.Confirm()
+		if _, ok := uploader.ctx["error"]; ok {
+			uploader.ErrorRedirect()
+		} else {
+			uploader.SuccessRedirect()
+		}
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultDateFormat = "01/02/2006"
+
+var DefaultTimeFormats = []string{"15:04:05", "15:04", "3:04:05 PM", "3:04 PM"}
+
+var strftimeDirectives = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'b': "Jan",
+	'h': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'j': "002",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'p': "PM",
+	'z': "-0700",
+	'Z': "MST",
+	'F': "2006-01-02",
+	'T': "15:04:05",
+	'D': "01/02/06",
+	'%': "%",
+}
+
+// The no-padding variants, e.g. %-d, as supported by glibc.
+var strftimeUnpadded = map[byte]string{
+	'm': "1",
+	'd': "2",
+	'I': "3",
+}
+
+// StrftimeLayout converts a strftime style format, e.g. "%d/%m/%Y", into a
+// Go time layout. Formats without a % are returned as is, so existing
+// profiles using Go layouts keep working.
+func StrftimeLayout(format string) (layout string, err error) {
+	if !strings.Contains(format, "%") {
+		return format, nil
+	}
+	var b strings.Builder
+	for ix := 0; ix < len(format); ix++ {
+		if format[ix] != '%' {
+			b.WriteByte(format[ix])
+			continue
+		}
+		ix++
+		directives := strftimeDirectives
+		if ix < len(format) && format[ix] == '-' {
+			directives = strftimeUnpadded
+			ix++
+		}
+		if ix >= len(format) {
+			err = errors.New(fmt.Sprintf("Date format %q ends in %%", format))
+			return
+		}
+		l, ok := directives[format[ix]]
+		if !ok {
+			err = errors.New(fmt.Sprintf("Unsupported directive %%%c in date format %q", format[ix], format))
+			return
+		}
+		b.WriteString(l)
+	}
+	layout = b.String()
+	return
+}
+
+var timeZoneAbbreviations = map[string]int{
+	"UTC":  0,
+	"GMT":  0,
+	"Z":    0,
+	"EST":  -5 * 3600,
+	"EDT":  -4 * 3600,
+	"CST":  -6 * 3600,
+	"CDT":  -5 * 3600,
+	"MST":  -7 * 3600,
+	"MDT":  -6 * 3600,
+	"PST":  -8 * 3600,
+	"PDT":  -7 * 3600,
+	"AST":  -4 * 3600,
+	"ADT":  -3 * 3600,
+	"NST":  -3*3600 - 1800,
+	"NDT":  -2*3600 - 1800,
+	"BST":  1 * 3600,
+	"CET":  1 * 3600,
+	"CEST": 2 * 3600,
+}
+
+var utcOffset = regexp.MustCompile(`^(?:UTC|GMT)?([+-])(\d{1,2}):?(\d{2})?$`)
+
+// ParseTimeZone returns the location for a time zone as it appears in
+// import files: an IANA name like "America/Toronto", a common abbreviation
+// like "EST", or an offset like "-05:00".
+func ParseTimeZone(zone string) (loc *time.Location, err error) {
+	zone = strings.TrimSpace(zone)
+	if offset, ok := timeZoneAbbreviations[strings.ToUpper(zone)]; ok {
+		return time.FixedZone(strings.ToUpper(zone), offset), nil
+	}
+	if m := utcOffset.FindStringSubmatch(zone); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		offset := hours*3600 + minutes*60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(zone, offset), nil
+	}
+	if loc, err = time.LoadLocation(zone); err != nil {
+		err = errors.New(fmt.Sprintf("Unknown time zone %q", zone))
+	}
+	return
+}
+
+// DateParser parses dates using a list of layouts, which are tried in order.
+// Layouts with a four digit year also accept two digit years. Dates without
+// an explicit time zone are taken to be in Location.
+type DateParser struct {
+	Layouts     []string
+	TimeLayouts []string
+	Location    *time.Location
+}
+
+func layouts(formats interface{}) (ret []string, err error) {
+	ret = make([]string, 0)
+	var l string
+	switch f := formats.(type) {
+	case nil:
+	case string:
+		if l, err = StrftimeLayout(f); err != nil {
+			return
+		}
+		ret = append(ret, l)
+	case []string:
+		for _, format := range f {
+			if l, err = StrftimeLayout(format); err != nil {
+				return
+			}
+			ret = append(ret, l)
+		}
+	case []interface{}:
+		for _, format := range f {
+			s, ok := format.(string)
+			if !ok {
+				err = errors.New(fmt.Sprintf("Date format %v is not a string", format))
+				return
+			}
+			if l, err = StrftimeLayout(s); err != nil {
+				return
+			}
+			ret = append(ret, l)
+		}
+	default:
+		err = errors.New(fmt.Sprintf("Date format %v is not a string or list of strings", formats))
+	}
+	return
+}
+
+// MakeDateParser creates a DateParser. formats and timeFormats are a format
+// or a list of formats; if they are nil, DefaultDateFormat and
+// DefaultTimeFormats are used. zone is the name of the time zone of dates
+// without one, which defaults to UTC.
+func MakeDateParser(formats interface{}, timeFormats interface{}, zone string) (parser *DateParser, err error) {
+	parser = &DateParser{Location: time.UTC}
+	if parser.Layouts, err = layouts(formats); err != nil {
+		return
+	}
+	if len(parser.Layouts) == 0 {
+		parser.Layouts = []string{DefaultDateFormat}
+	}
+	if parser.TimeLayouts, err = layouts(timeFormats); err != nil {
+		return
+	}
+	if len(parser.TimeLayouts) == 0 {
+		parser.TimeLayouts = DefaultTimeFormats
+	}
+	if zone != "" {
+		parser.Location, err = ParseTimeZone(zone)
+	}
+	return
+}
+
+func (parser *DateParser) candidates() (ret []string) {
+	ret = make([]string, 0, 2*len(parser.Layouts))
+	for _, layout := range parser.Layouts {
+		ret = append(ret, layout)
+		if strings.Contains(layout, "2006") {
+			ret = append(ret, strings.Replace(layout, "2006", "06", 1))
+		}
+	}
+	return
+}
+
+// Parse parses a date, optionally combined with the time of day and time
+// zone found in separate columns. Either of these can be empty.
+func (parser *DateParser) Parse(date string, tod string, zone string) (t time.Time, err error) {
+	date = strings.TrimSpace(date)
+	tod = strings.TrimSpace(tod)
+	loc := parser.Location
+	if zone = strings.TrimSpace(zone); zone != "" {
+		if loc, err = ParseTimeZone(zone); err != nil {
+			return
+		}
+	}
+	for _, layout := range parser.candidates() {
+		if tod == "" {
+			if t, err = time.ParseInLocation(layout, date, loc); err == nil {
+				return
+			}
+			continue
+		}
+		for _, timeLayout := range parser.TimeLayouts {
+			if t, err = time.ParseInLocation(layout+" "+timeLayout, date+" "+tod, loc); err == nil {
+				return
+			}
+		}
+	}
+	if tod != "" {
+		date += " " + tod
+	}
+	err = errors.New(fmt.Sprintf("Could not parse date %q", date))
+	return
+}
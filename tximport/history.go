@@ -0,0 +1,190 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/finn/render"
+	"github.com/JanDeVisser/grumble"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func (imp *TXImport) ManyQuery(query *grumble.Query, values url.Values) (ret *grumble.Query) {
+	ret = model.AddAccountCondition(query, values)
+	query.AddSort(grumble.Sort{Column: "Timestamp"})
+	return
+}
+
+// GetImports returns the imports for the account, most recent first.
+func GetImports(account *model.Account) (imports []*TXImport, err error) {
+	q := account.Manager().MakeQuery(&TXImport{})
+	q.AddCondition(grumble.HasParent{Parent: account.AsKey()})
+	q.AddSort(grumble.Sort{Column: "Timestamp"})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	imports = make([]*TXImport, len(results))
+	for ix, row := range results {
+		imports[len(results)-ix-1] = row[0].(*TXImport)
+	}
+	return
+}
+
+func GetImport(mgr *grumble.EntityManager, id int) (imp *TXImport, err error) {
+	e, err := mgr.Get(TXImport{}, id)
+	if err != nil {
+		return
+	}
+	imp, ok := e.(*TXImport)
+	if !ok || imp == nil {
+		err = errors.New(fmt.Sprintf("No import with ID %d found", id))
+	}
+	return
+}
+
+func (imp *TXImport) ErrorLines() []string {
+	if imp.Errors == "" {
+		return []string{}
+	}
+	return strings.Split(imp.Errors, "\n")
+}
+
+// Undo deletes all transactions created by this import in one database
+// transaction. Transfers created by the import are deleted on both sides.
+// If a transfer was paired up with a transaction from elsewhere, e.g. by
+// MatchTransfers, the other side is turned back into a plain transaction.
+func (imp *TXImport) Undo() (deleted int, err error) {
+	mgr := imp.Manager()
+	err = mgr.TX(func(db *sql.DB) (err error) {
+		var txs []grumble.Persistable
+		if txs, err = model.GetImportedTransactions(mgr, imp.Id()); err != nil {
+			return
+		}
+		if err = model.CheckUnlocked(txs...); err != nil {
+			return
+		}
+		ids := make(map[int]bool)
+		for _, tx := range txs {
+			ids[tx.Id()] = true
+		}
+		for _, tx := range txs {
+			if transfer, ok := tx.(*model.TransferTx); ok && transfer.CrossPost != nil && !ids[transfer.CrossPost.Id()] {
+				if err = transfer.RevertCrossPost(); err != nil {
+					return
+				}
+			}
+			if err = mgr.Delete(tx); err != nil {
+				return
+			}
+			deleted++
+		}
+		imp.Status = Undone
+		return mgr.Put(imp)
+	})
+	return
+}
+
+func ImportHistory(w http.ResponseWriter, r *http.Request) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := model.PathId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	account, err := model.GetAccount(mgr, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	imports, err := GetImports(account)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx := make(map[string]interface{})
+	ctx["Account"] = account
+	ctx["Imports"] = imports
+	render.RenderTemplate(w, "imports", ctx)
+}
+
+func ImportDetails(w http.ResponseWriter, r *http.Request) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := model.PathId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	imp, err := GetImport(mgr, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	lineErrors, err := imp.GetLineErrors()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx := make(map[string]interface{})
+	ctx["Import"] = imp
+	ctx["LineErrors"] = lineErrors
+	render.RenderTemplate(w, "import", ctx)
+}
+
+func UndoImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Imports can only be undone using POST", http.StatusMethodNotAllowed)
+		return
+	}
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		model.RedirectError(w, r, err)
+		return
+	}
+	id, err := model.PathId(r)
+	if err != nil {
+		model.RedirectError(w, r, err)
+		return
+	}
+	imp, err := GetImport(mgr, id)
+	if err != nil {
+		model.RedirectError(w, r, err)
+		return
+	}
+	deleted, err := imp.Undo()
+	if err != nil {
+		model.RedirectError(w, r, err)
+	} else {
+		model.RedirectSuccess(w, r, fmt.Sprintf("Import %q undone, %d transactions deleted", imp.FileName, deleted))
+	}
+}
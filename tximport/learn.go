@@ -0,0 +1,369 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/finn/handler"
+	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/finn/render"
+	"github.com/JanDeVisser/grumble"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	SuggestionOpen     = "Open"
+	SuggestionAccepted = "Accepted"
+	SuggestionRejected = "Rejected"
+)
+
+// RuleSuggestion is a template proposed when the category, contact or
+// project of a transaction is changed by hand. Accepting it adds the
+// template to the account's import profile.
+type RuleSuggestion struct {
+	grumble.Key
+	Created     time.Time
+	TxId        int
+	Description string
+	Template    string
+	Category    string
+	Contact     string
+	Project     string
+	Status      string
+}
+
+// SuggestTemplate derives a regular expression from a transaction
+// description, dropping store and reference numbers.
+func SuggestTemplate(description string) string {
+	key := unmatchedKey(description)
+	if key == "" {
+		key = strings.TrimSpace(description)
+	}
+	return "^" + regexp.QuoteMeta(key)
+}
+
+// referenceNames returns the names of the category, contact and project of
+// the transaction. References which were not loaded with their names are
+// read from the database.
+func referenceNames(mgr *grumble.EntityManager, tx *model.Transaction) (names map[string]string, err error) {
+	names = make(map[string]string)
+	for field, ref := range map[string]grumble.Persistable{
+		"category": tx.Category,
+		"contact":  tx.Contact,
+		"project":  tx.Project,
+	} {
+		if reflect.ValueOf(ref).IsNil() {
+			continue
+		}
+		if names[field] = referenceName(ref); names[field] == "" && ref.Id() > 0 {
+			var e grumble.Persistable
+			if e, err = mgr.Get(ref.Kind(), ref.Id()); err != nil {
+				return
+			}
+			names[field] = referenceName(e)
+		}
+	}
+	return
+}
+
+// profileImporter returns an importer with the templates of the account's
+// import profile. An account without a profile has no templates.
+func profileImporter(account *model.Account) (imp *CSVImporter, err error) {
+	imp = &CSVImporter{Account: account}
+	if err = imp.parseTemplate(); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// learnFromUpdate is called when a transaction is updated through the JSON
+// API. If its category, contact or project changed and the account's
+// templates would not have assigned the new values, a template is
+// suggested.
+func learnFromUpdate(before grumble.Persistable, after grumble.Persistable) (err error) {
+	old, tx := model.TransactionOf(before), model.TransactionOf(after)
+	if old == nil || tx == nil || (tx.TXType != model.Debit && tx.TXType != model.Credit) {
+		return
+	}
+	mgr := tx.Manager()
+	oldNames, err := referenceNames(mgr, old)
+	if err != nil {
+		return
+	}
+	names, err := referenceNames(mgr, tx)
+	if err != nil {
+		return
+	}
+	changed := false
+	for _, field := range []string{"category", "contact", "project"} {
+		if names[field] != oldNames[field] && names[field] != "" {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	account, err := model.GetAccount(mgr, tx.Parent().Id())
+	if err != nil {
+		return
+	}
+	imp, err := profileImporter(account)
+	if err != nil {
+		return
+	}
+	fields := map[string]string{"description": tx.Description}
+	if names["contact"] != "" {
+		fields["contact"] = names["contact"]
+	}
+	imp.ApplyTemplates(fields, tx.Amt)
+	if fields["category"] == names["category"] && fields["contact"] == names["contact"] && fields["project"] == names["project"] {
+		return
+	}
+
+	suggestion := &RuleSuggestion{Template: SuggestTemplate(tx.Description)}
+	suggestions, err := GetRuleSuggestions(account, SuggestionOpen)
+	if err != nil {
+		return
+	}
+	for _, s := range suggestions {
+		if s.Template == suggestion.Template {
+			suggestion = s
+			break
+		}
+	}
+	if suggestion.Id() == 0 {
+		suggestion.Initialize(account, 0)
+	}
+	suggestion.Created = time.Now()
+	suggestion.TxId = tx.Id()
+	suggestion.Description = tx.Description
+	suggestion.Category = names["category"]
+	suggestion.Contact = names["contact"]
+	suggestion.Project = names["project"]
+	suggestion.Status = SuggestionOpen
+	return mgr.Put(suggestion)
+}
+
+func statusCondition(status string) grumble.SimpleCondition {
+	switch status {
+	case SuggestionOpen, SuggestionAccepted, SuggestionRejected:
+		return grumble.SimpleCondition{SQL: fmt.Sprintf("k.\"Status\" = '%s'", status)}
+	}
+	return grumble.SimpleCondition{SQL: "FALSE"}
+}
+
+func GetRuleSuggestions(account *model.Account, status string) (suggestions []*RuleSuggestion, err error) {
+	q := account.Manager().MakeQuery(&RuleSuggestion{})
+	q.AddCondition(grumble.HasParent{Parent: account.AsKey()})
+	if status != "" {
+		q.AddCondition(statusCondition(status))
+	}
+	q.AddSort(grumble.Sort{Column: "Created"})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	suggestions = make([]*RuleSuggestion, len(results))
+	for ix, row := range results {
+		suggestions[ix] = row[0].(*RuleSuggestion)
+	}
+	return
+}
+
+func GetRuleSuggestion(mgr *grumble.EntityManager, id int) (suggestion *RuleSuggestion, err error) {
+	e, err := mgr.Get(RuleSuggestion{}, id)
+	if err != nil {
+		return
+	}
+	suggestion, ok := e.(*RuleSuggestion)
+	if !ok || suggestion == nil {
+		err = errors.New(fmt.Sprintf("No rule suggestion with ID %d found", id))
+	}
+	return
+}
+
+func (suggestion *RuleSuggestion) Account() (*model.Account, error) {
+	return model.GetAccount(suggestion.Manager(), suggestion.Parent().Id())
+}
+
+// Accept adds the suggested template to the account's import profile. It is
+// given a priority above all existing templates, so that it overrides the
+// template which categorized the transaction wrongly. If apply is set, the
+// template is applied to the existing transactions it matches, overwriting
+// their categories, contacts and projects. Accept returns the number of
+// transactions changed. The profile, the suggestion and the transactions are
+// updated in one database transaction.
+func (suggestion *RuleSuggestion) Accept(apply bool) (count int, err error) {
+	if suggestion.Status != SuggestionOpen {
+		err = errors.New(fmt.Sprintf("Rule suggestion %q is already %s", suggestion.Template, strings.ToLower(suggestion.Status)))
+		return
+	}
+	account, err := suggestion.Account()
+	if err != nil {
+		return
+	}
+	imp, err := profileImporter(account)
+	if err != nil {
+		return
+	}
+	priority := 0
+	for _, tmpl := range imp.Templates {
+		if tmpl.Priority >= priority {
+			priority = tmpl.Priority + 1
+		}
+	}
+	template := map[string]interface{}{
+		"template": suggestion.Template,
+		"matchon":  "description",
+		"priority": float64(priority),
+	}
+	for key, value := range map[string]string{
+		"category": suggestion.Category,
+		"contact":  suggestion.Contact,
+		"project":  suggestion.Project,
+	} {
+		if value != "" {
+			template[key] = value
+		}
+	}
+	mgr := suggestion.Manager()
+	err = mgr.TX(func(db *sql.DB) (err error) {
+		if _, err = AddTemplate(account, template); err != nil {
+			return
+		}
+		suggestion.Status = SuggestionAccepted
+		if err = mgr.Put(suggestion); err != nil || !apply {
+			return
+		}
+		var recat *Recategorization
+		if recat, err = MakeRecategorization(account, true); err != nil {
+			return
+		}
+		recat.only = suggestion.Template
+		count, err = recat.Apply()
+		return
+	})
+	return
+}
+
+func (suggestion *RuleSuggestion) Reject() error {
+	suggestion.Status = SuggestionRejected
+	return suggestion.Manager().Put(suggestion)
+}
+
+func (suggestion *RuleSuggestion) ManyQuery(query *grumble.Query, values url.Values) (ret *grumble.Query) {
+	ret = model.AddAccountCondition(query, values)
+	if values.Get("status") != "" {
+		query.AddCondition(statusCondition(values.Get("status")))
+	}
+	query.AddSort(grumble.Sort{Column: "Created"})
+	return
+}
+
+// RuleSuggestions lists the open rule suggestions of an account.
+func RuleSuggestions(w http.ResponseWriter, r *http.Request) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := model.PathId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	account, err := model.GetAccount(mgr, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	suggestions, err := GetRuleSuggestions(account, SuggestionOpen)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx := make(map[string]interface{})
+	ctx["Account"] = account
+	ctx["Suggestions"] = suggestions
+	render.RenderTemplate(w, "suggestions", ctx)
+}
+
+func suggestionFromRequest(w http.ResponseWriter, r *http.Request) (suggestion *RuleSuggestion) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Rule suggestions can only be accepted or rejected using POST", http.StatusMethodNotAllowed)
+		return
+	}
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		model.RedirectError(w, r, err)
+		return
+	}
+	id, err := model.PathId(r)
+	if err != nil {
+		model.RedirectError(w, r, err)
+		return
+	}
+	if suggestion, err = GetRuleSuggestion(mgr, id); err != nil {
+		model.RedirectError(w, r, err)
+		return nil
+	}
+	return
+}
+
+// AcceptSuggestion handles POST /suggestion/accept/<id>. If the form value
+// "apply" is set, the new template is applied to existing transactions.
+func AcceptSuggestion(w http.ResponseWriter, r *http.Request) {
+	suggestion := suggestionFromRequest(w, r)
+	if suggestion == nil {
+		return
+	}
+	count, err := suggestion.Accept(r.FormValue("apply") != "")
+	if err != nil {
+		model.RedirectError(w, r, err)
+	} else {
+		model.RedirectSuccess(w, r, fmt.Sprintf("Template %q added, %d transactions recategorized", suggestion.Template, count))
+	}
+}
+
+// RejectSuggestion handles POST /suggestion/reject/<id>.
+func RejectSuggestion(w http.ResponseWriter, r *http.Request) {
+	suggestion := suggestionFromRequest(w, r)
+	if suggestion == nil {
+		return
+	}
+	if err := suggestion.Reject(); err != nil {
+		model.RedirectError(w, r, err)
+	} else {
+		model.RedirectSuccess(w, r, fmt.Sprintf("Template %q rejected", suggestion.Template))
+	}
+}
+
+func init() {
+	grumble.GetKind(&RuleSuggestion{})
+	handler.AddUpdateHook(grumble.GetKind(&model.Transaction{}), learnFromUpdate)
+}
@@ -0,0 +1,189 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/grumble"
+	"net/http"
+	"strings"
+)
+
+// FieldError is returned when a single field of an import line could not be
+// converted. Column is the name of the mapped column.
+type FieldError struct {
+	Column string
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Column, e.Err)
+}
+
+// ImportLineError records a line of a TXImport which could not be imported.
+// Raw holds the fields of the line, CSV encoded.
+type ImportLineError struct {
+	grumble.Key
+	Line   int
+	Raw    string
+	Column string
+	Error  string
+}
+
+func (lineError *ImportLineError) Fields() (fields []string) {
+	fields, err := csv.NewReader(strings.NewReader(lineError.Raw)).Read()
+	if err != nil {
+		fields = []string{lineError.Raw}
+	}
+	return
+}
+
+func (imp *TXImport) AddLineError(line int, raw []string, err error) error {
+	lineError := &ImportLineError{Line: line, Error: err.Error()}
+	if fieldError, ok := err.(*FieldError); ok {
+		lineError.Column = fieldError.Column
+		lineError.Error = fieldError.Err.Error()
+	}
+	if len(raw) > 0 {
+		var b strings.Builder
+		w := csv.NewWriter(&b)
+		_ = w.Write(raw)
+		w.Flush()
+		lineError.Raw = strings.TrimRight(b.String(), "\n")
+	}
+	if imp.preview != nil {
+		return nil
+	}
+	lineError.Initialize(imp, 0)
+	return imp.Manager().Put(lineError)
+}
+
+// GetLineErrors returns the line errors of the import, ordered by line
+// number.
+func (imp *TXImport) GetLineErrors() (lineErrors []*ImportLineError, err error) {
+	q := imp.Manager().MakeQuery(&ImportLineError{})
+	q.AddCondition(grumble.HasParent{Parent: imp.AsKey()})
+	q.AddSort(grumble.Sort{Column: "Line"})
+	results, err := q.Execute()
+	if err != nil {
+		return
+	}
+	lineErrors = make([]*ImportLineError, len(results))
+	for ix, row := range results {
+		lineErrors[ix] = row[0].(*ImportLineError)
+	}
+	return
+}
+
+// dropLineErrors removes the messages added by Tally for the given lines
+// from Errors.
+func (imp *TXImport) dropLineErrors(lines map[int]bool) {
+	kept := make([]string, 0)
+	for _, msg := range imp.ErrorLines() {
+		var line int
+		if n, _ := fmt.Sscanf(msg, "Line %d:", &line); n == 1 && lines[line] {
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	imp.Errors = strings.Join(kept, "\n")
+}
+
+// Rerun imports the lines which failed before again, using the current
+// import profile of the account. The line errors of these lines are removed
+// and replaced by new ones for lines that fail again. If the re-run fails,
+// the import is left as it was.
+func (imp *TXImport) Rerun() (err error) {
+	if imp.Status == Undone {
+		return errors.New(fmt.Sprintf("Import %q was undone", imp.FileName))
+	}
+	if imp.account == nil {
+		if imp.account, err = model.GetAccount(imp.Manager(), imp.Parent().Id()); err != nil {
+			return
+		}
+	}
+	if imp.importer, err = GetImporter(imp.account); err != nil {
+		return
+	}
+	lineImporter, ok := imp.importer.(LineImporter)
+	if !ok {
+		return errors.New(fmt.Sprintf("Importer %q cannot re-run single lines", imp.account.Importer))
+	}
+	saved := *imp
+	err = imp.Manager().TX(func(db *sql.DB) (err error) {
+		var lineErrors []*ImportLineError
+		if lineErrors, err = imp.GetLineErrors(); err != nil {
+			return
+		}
+		lines := make(map[int]bool)
+		for _, lineError := range lineErrors {
+			lines[lineError.Line] = true
+			if err = imp.Manager().Delete(lineError); err != nil {
+				return
+			}
+		}
+		imp.Total -= len(lineErrors)
+		imp.Bad -= len(lineErrors)
+		imp.dropLineErrors(lines)
+		return lineImporter.ProcessLines(imp, lines)
+	})
+	if err != nil {
+		imp.Total, imp.Good, imp.Bad, imp.Skipped = saved.Total, saved.Good, saved.Bad, saved.Skipped
+		imp.Errors, imp.Status = saved.Errors, saved.Status
+		return
+	}
+	imp.finish(nil)
+	return
+}
+
+func RerunImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Imports can only be re-run using POST", http.StatusMethodNotAllowed)
+		return
+	}
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		model.RedirectError(w, r, err)
+		return
+	}
+	id, err := model.PathId(r)
+	if err != nil {
+		model.RedirectError(w, r, err)
+		return
+	}
+	imp, err := GetImport(mgr, id)
+	if err != nil {
+		model.RedirectError(w, r, err)
+		return
+	}
+	if err = imp.Rerun(); err != nil {
+		model.RedirectError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/import/%d", imp.Id()), http.StatusSeeOther)
+}
+
+func init() {
+	grumble.GetKind(&ImportLineError{})
+}
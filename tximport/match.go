@@ -0,0 +1,180 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/grumble"
+	"strings"
+	"time"
+)
+
+// DefaultMatchWindow is the number of days two sides of a transfer are
+// allowed to be apart when no explicit window is given.
+const DefaultMatchWindow = 3
+
+type matchCandidate struct {
+	account *model.Account
+	tx      *model.Transaction
+	matched bool
+}
+
+type AmbiguousTransfer struct {
+	Account     *model.Account
+	Transaction *model.Transaction
+	Candidates  []*model.Transaction
+}
+
+type TransferMatch struct {
+	Window    int
+	Matched   int
+	Ambiguous []AmbiguousTransfer
+	account   *model.Account
+	byAmount  map[model.Money][]*matchCandidate
+}
+
+// MakeTransferMatch prepares a reconciliation pass which pairs up opposite
+// transactions in different accounts. If account is not nil, only pairs with
+// one side in that account are considered. Two transactions are paired if
+// their dates are at most window days apart.
+func MakeTransferMatch(account *model.Account, window int) (match *TransferMatch) {
+	if window <= 0 {
+		window = DefaultMatchWindow
+	}
+	match = &TransferMatch{Window: window, account: account}
+	match.Ambiguous = make([]AmbiguousTransfer, 0)
+	return
+}
+
+func (match *TransferMatch) load(mgr *grumble.EntityManager) (err error) {
+	accounts, err := model.GetAccounts(mgr, nil)
+	if err != nil {
+		return
+	}
+	match.byAmount = make(map[model.Money][]*matchCandidate)
+	for _, acc := range accounts {
+		q := mgr.MakeQuery(&model.Transaction{})
+		q.WithDerived = false
+		q.AddCondition(grumble.HasParent{Parent: acc.AsKey()})
+		var results [][]grumble.Persistable
+		if results, err = q.Execute(); err != nil {
+			return
+		}
+		for _, row := range results {
+			tx, ok := row[0].(*model.Transaction)
+			if !ok || tx.Locked() {
+				continue
+			}
+			match.byAmount[tx.Amt] = append(match.byAmount[tx.Amt], &matchCandidate{account: acc, tx: tx})
+		}
+	}
+	return
+}
+
+func (match *TransferMatch) candidates(c *matchCandidate) (ret []*matchCandidate) {
+	ret = make([]*matchCandidate, 0)
+	window := time.Duration(match.Window) * 24 * time.Hour
+	for _, other := range match.byAmount[-c.tx.Amt] {
+		if other.matched || other.account.Id() == c.account.Id() {
+			continue
+		}
+		diff := other.tx.Date.Sub(c.tx.Date)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff <= window {
+			ret = append(ret, other)
+		}
+	}
+	return
+}
+
+func (match *TransferMatch) inScope(c *matchCandidate) bool {
+	return match.account == nil || c.account.Id() == match.account.Id()
+}
+
+// Run loads all transactions that are not transfers yet, and converts every
+// unambiguous pair into a linked pair of transfer transactions. Pairs for
+// which more than one counterpart qualifies are left alone and reported in
+// Ambiguous.
+func (match *TransferMatch) Run(mgr *grumble.EntityManager) (err error) {
+	return mgr.TX(func(db *sql.DB) (err error) {
+		if err = match.load(mgr); err != nil {
+			return
+		}
+		for amt, txs := range match.byAmount {
+			if amt <= 0 {
+				continue
+			}
+			for _, c := range txs {
+				if c.matched {
+					continue
+				}
+				candidates := match.candidates(c)
+				if len(candidates) == 0 {
+					continue
+				}
+				other := candidates[0]
+				if !match.inScope(c) && !match.inScope(other) {
+					continue
+				}
+				if len(candidates) > 1 || len(match.candidates(other)) > 1 {
+					ambiguous := AmbiguousTransfer{Account: c.account, Transaction: c.tx}
+					for _, cand := range candidates {
+						ambiguous.Candidates = append(ambiguous.Candidates, cand.tx)
+					}
+					match.Ambiguous = append(match.Ambiguous, ambiguous)
+					continue
+				}
+				if err = c.account.ConvertToTransfer(c.tx, other.account, other.tx); err != nil {
+					return
+				}
+				c.matched = true
+				other.matched = true
+				match.Matched++
+			}
+		}
+		return
+	})
+}
+
+func (match *TransferMatch) String() string {
+	msg := fmt.Sprintf("Matched %d transfers", match.Matched)
+	if len(match.Ambiguous) > 0 {
+		descriptions := make([]string, len(match.Ambiguous))
+		for ix, ambiguous := range match.Ambiguous {
+			descriptions[ix] = fmt.Sprintf("%s %s %s %q (%d candidates)",
+				ambiguous.Account.AccName, ambiguous.Transaction.Date.Format("2006-01-02"),
+				ambiguous.Transaction.Amt, ambiguous.Transaction.Description, len(ambiguous.Candidates))
+		}
+		msg = fmt.Sprintf("%s, %d ambiguous: %s", msg, len(match.Ambiguous), strings.Join(descriptions, "; "))
+	}
+	return msg
+}
+
+// MatchTransfers runs a reconciliation pass over all accounts using the
+// given window.
+func MatchTransfers(mgr *grumble.EntityManager, window int) (match *TransferMatch, err error) {
+	match = MakeTransferMatch(nil, window)
+	err = match.Run(mgr)
+	return
+}
@@ -0,0 +1,312 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/grumble"
+	"html"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OFXNode is an element in an OFX document. OFX 1.x is SGML, where
+// elements holding a value do not have an end tag, and OFX 2.x is XML. Both
+// parse into the same tree.
+type OFXNode struct {
+	Name     string
+	Value    string
+	Children []*OFXNode
+}
+
+func (node *OFXNode) Get(name string) string {
+	for _, child := range node.Children {
+		if child.Name == name {
+			return child.Value
+		}
+	}
+	return ""
+}
+
+func (node *OFXNode) Child(name string) *OFXNode {
+	for _, child := range node.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// FindAll returns all descendants of this node with the given name.
+func (node *OFXNode) FindAll(name string) (ret []*OFXNode) {
+	ret = make([]*OFXNode, 0)
+	for _, child := range node.Children {
+		if child.Name == name {
+			ret = append(ret, child)
+		}
+		ret = append(ret, child.FindAll(name)...)
+	}
+	return
+}
+
+// ParseOFX parses an OFX document. Everything before the <OFX> root element,
+// i.e. the SGML header block or the XML processing instructions, is skipped.
+func ParseOFX(data string) (root *OFXNode, err error) {
+	start := strings.Index(strings.ToUpper(data), "<OFX>")
+	if start < 0 {
+		err = errors.New("No <OFX> element found")
+		return
+	}
+	data = data[start:]
+	stack := make([]*OFXNode, 0)
+	for len(data) > 0 {
+		open := strings.Index(data, "<")
+		if open < 0 {
+			break
+		}
+		end := strings.Index(data[open:], ">")
+		if end < 0 {
+			err = errors.New("Unterminated OFX tag")
+			return
+		}
+		tag := strings.TrimSpace(data[open+1 : open+end])
+		data = data[open+end+1:]
+		switch {
+		case strings.HasPrefix(tag, "?"), strings.HasPrefix(tag, "!"):
+			continue
+		case strings.HasPrefix(tag, "/"):
+			name := strings.ToUpper(tag[1:])
+			for ix := len(stack) - 1; ix >= 0; ix-- {
+				if stack[ix].Name == name {
+					stack = stack[:ix]
+					break
+				}
+			}
+		default:
+			node := &OFXNode{Name: strings.ToUpper(tag), Children: make([]*OFXNode, 0)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			} else if root == nil {
+				root = node
+			}
+			value := data
+			if next := strings.Index(data, "<"); next >= 0 {
+				value = data[:next]
+			}
+			node.Value = html.UnescapeString(strings.TrimSpace(value))
+			if node.Value == "" {
+				stack = append(stack, node)
+			}
+		}
+	}
+	if root == nil {
+		err = errors.New("Empty OFX document")
+	}
+	return
+}
+
+// ParseOFXDate parses OFX datetime values, which look like
+// YYYYMMDD[HHMMSS[.XXX]][[gmt offset[:tz name]]]. Only the date part is used.
+func ParseOFXDate(s string) (t time.Time, err error) {
+	if len(s) < 8 {
+		err = errors.New(fmt.Sprintf("Invalid OFX date %q", s))
+		return
+	}
+	return time.Parse("20060102", s[:8])
+}
+
+type OFXImporter struct {
+	*CSVImporter
+}
+
+// statements returns the bank and credit card statements in the document.
+// If the document holds more than one, only the statements for the account
+// number of the account are returned.
+func (imp *OFXImporter) statements(root *OFXNode) (ret []*OFXNode) {
+	all := append(root.FindAll("STMTRS"), root.FindAll("CCSTMTRS")...)
+	if len(all) <= 1 {
+		return all
+	}
+	ret = make([]*OFXNode, 0)
+	for _, stmt := range all {
+		for _, acct := range append(stmt.FindAll("BANKACCTFROM"), stmt.FindAll("CCACCTFROM")...) {
+			if acct.Get("ACCTID") == imp.Account.AccNr {
+				ret = append(ret, stmt)
+				break
+			}
+		}
+	}
+	return
+}
+
+func (imp *OFXImporter) Process(txImport *TXImport) (err error) {
+	var root *OFXNode
+	if root, err = ParseOFX(txImport.Data); err != nil {
+		return
+	}
+	txImport.Reset()
+	return imp.processStatements(txImport, root, nil)
+}
+
+// ProcessLines imports the STMTTRN elements with the given ordinals, or all
+// of them if lines is nil. Ordinals start at 1.
+func (imp *OFXImporter) ProcessLines(txImport *TXImport, lines map[int]bool) (err error) {
+	var root *OFXNode
+	if root, err = ParseOFX(txImport.Data); err != nil {
+		return
+	}
+	return imp.processStatements(txImport, root, lines)
+}
+
+func (imp *OFXImporter) processStatements(txImport *TXImport, root *OFXNode, lines map[int]bool) (err error) {
+	num := 0
+	for _, stmt := range imp.statements(root) {
+		currency := stmt.Get("CURDEF")
+		if currency == "" {
+			currency = imp.Account.CurrencyCode()
+		}
+		for _, trn := range stmt.FindAll("STMTTRN") {
+			num++
+			if lines != nil && !lines[num] {
+				continue
+			}
+			raw := []string{trn.Get("FITID"), trn.Get("DTPOSTED"), trn.Get("TRNAMT"), trn.Get("NAME"), trn.Get("MEMO")}
+			txImport.Tally(num, raw, imp.SaveStatementLine(txImport, trn, currency))
+		}
+	}
+	return
+}
+
+// SaveStatementLine books a STMTTRN element. For lines with a FITID that was
+// imported into the account before ErrDuplicate is returned.
+func (imp *OFXImporter) SaveStatementLine(txImport *TXImport, trn *OFXNode, currency string) (err error) {
+	fitId := trn.Get("FITID")
+	if fitId != "" {
+		var exists bool
+		if exists, err = imp.Account.HasTransaction(fitId); err != nil {
+			return
+		}
+		if exists {
+			return ErrDuplicate
+		}
+	}
+	fields := make(map[string]string)
+	fields["description"] = trn.Get("NAME")
+	fields["memo"] = trn.Get("MEMO")
+	if fields["description"] == "" {
+		fields["description"] = fields["memo"]
+	}
+	fields["fitid"] = fitId
+	fields["trntype"] = trn.Get("TRNTYPE")
+	fields["amt"] = trn.Get("TRNAMT")
+
+	var amt model.Money
+	if amt, err = model.ParseMoney(strings.Replace(fields["amt"], ",", ".", -1)); err != nil {
+		err = &FieldError{Column: "TRNAMT", Err: err}
+		return
+	}
+	fields["type"] = model.Debit
+	if amt > 0 {
+		fields["type"] = model.Credit
+	}
+	imp.ApplyTemplates(fields, amt)
+
+	var txp grumble.Persistable
+	if txp, err = imp.Account.MakeTransaction(fields["type"]); err != nil {
+		return
+	}
+	var tx *model.Transaction
+	switch t := txp.(type) {
+	case *model.TransferTx:
+		tx = &t.Transaction
+	case *model.Transaction:
+		tx = t
+	default:
+		return errors.New(fmt.Sprintf("Cannot import OFX line as transaction type %q", fields["type"]))
+	}
+	if tx.Date, err = ParseOFXDate(trn.Get("DTPOSTED")); err != nil {
+		err = &FieldError{Column: "DTPOSTED", Err: err}
+		return
+	}
+	tx.Amt = amt
+	tx.Description = fields["description"]
+	tx.ExternalId = fitId
+	if err = imp.foreignCurrency(tx, trn, currency); err != nil {
+		return
+	}
+	return imp.Save(txImport, txp, fields)
+}
+
+// foreignCurrency handles the currency aggregates of a STMTTRN. With
+// <CURRENCY>, TRNAMT is in the foreign currency and is converted into the
+// statement currency. With <ORIGCURRENCY>, TRNAMT was already converted by
+// the bank and the original amount is computed. CURRATE is the value of one
+// unit of the foreign currency in the statement currency. Without it, the
+// stored exchange rates are used; for <CURRENCY> that is done by Save.
+func (imp *OFXImporter) foreignCurrency(tx *model.Transaction, trn *OFXNode, currency string) (err error) {
+	foreign := func(name string) (cur *OFXNode, rate float64) {
+		if cur = trn.Child(name); cur == nil || cur.Get("CURSYM") == "" || cur.Get("CURSYM") == currency {
+			return nil, 0
+		}
+		if r, e := strconv.ParseFloat(cur.Get("CURRATE"), 64); e == nil {
+			rate = r
+		}
+		return
+	}
+	if cur, rate := foreign("CURRENCY"); cur != nil {
+		tx.Currency = cur.Get("CURSYM")
+		if rate != 0 {
+			tx.ForeignAmt = tx.Amt
+			tx.Amt = tx.ForeignAmt.Mul(rate)
+		}
+	} else if cur, rate := foreign("ORIGCURRENCY"); cur != nil {
+		tx.Currency = cur.Get("CURSYM")
+		if rate != 0 {
+			tx.ForeignAmt = tx.Amt.Mul(1 / rate)
+		} else {
+			tx.ForeignAmt, err = model.ConvertMoney(imp.Account.Manager(), tx.Amt, currency, tx.Currency, tx.Date)
+		}
+	}
+	return
+}
+
+// MakeOFXImporter returns an importer for OFX and QFX statements. A template
+// file for the account is optional, since OFX statements do not need a
+// column mapping.
+func MakeOFXImporter(account *model.Account) (ret Importer, err error) {
+	imp := &OFXImporter{CSVImporter: &CSVImporter{Account: account}}
+	if err = imp.parseTemplate(); err != nil {
+		if !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+	}
+	ret = imp
+	return
+}
+
+func init() {
+	importers["OFX"] = MakeOFXImporter
+}
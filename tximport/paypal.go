@@ -0,0 +1,321 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/grumble"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PayPal activity rows with one of these types only move money around to
+// fund a payment. They are not booked themselves; the bank side of a deposit
+// is booked as a transfer by the bank's importer.
+const (
+	PayPalBankDeposit        = "Bank Deposit to PP Account"
+	PayPalCurrencyConversion = "General Currency Conversion"
+	PayPalFundsPayable       = "Funds Payable"
+	PayPalFundsReceivable    = "Funds Receivable"
+)
+
+const PayPalCompleted = "Completed"
+
+// PayPalDateFormat is the date format of PayPal exports. It can be
+// overridden by setting "dateformat" in the config section of the account's
+// import profile.
+const PayPalDateFormat = "%d/%m/%Y"
+
+var payPalColumns = []string{"date", "time", "timezone", "name", "type", "status", "currency", "amount"}
+
+// The column headers in some exports carry a column number suffix, e.g.
+// "Date 0".
+var payPalHeader = regexp.MustCompile(`^(.*?)\s*\d*$`)
+
+type payPalLine struct {
+	Line      int
+	Raw       []string
+	Stamp     string
+	Id        string
+	Reference string
+	Date      time.Time
+	Name      string
+	Type      string
+	Status    string
+	Currency  string
+	Amount    model.Money
+}
+
+func (line *payPalLine) IsFunding() bool {
+	switch line.Type {
+	case PayPalBankDeposit, PayPalCurrencyConversion, PayPalFundsPayable, PayPalFundsReceivable:
+		return true
+	}
+	return false
+}
+
+type PayPalImporter struct {
+	*CSVImporter
+	columns map[string]int
+	dates   *DateParser
+}
+
+func (imp *PayPalImporter) parseHeader(header []string) (err error) {
+	imp.columns = make(map[string]int)
+	for ix, col := range header {
+		col = strings.TrimPrefix(col, "\ufeff")
+		col = payPalHeader.FindStringSubmatch(strings.TrimSpace(col))[1]
+		imp.columns[strings.ToLower(col)] = ix
+	}
+	for _, col := range payPalColumns {
+		if _, ok := imp.columns[col]; !ok {
+			err = errors.New(fmt.Sprintf("PayPal export has no %q column", col))
+			return
+		}
+	}
+	return
+}
+
+func (imp *PayPalImporter) parseLine(num int, record []string) (line *payPalLine, err error) {
+	get := func(col string) string {
+		ix, ok := imp.columns[col]
+		if !ok || ix >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[ix])
+	}
+	line = &payPalLine{
+		Line:      num,
+		Raw:       record,
+		Id:        get("transaction id"),
+		Reference: get("reference txn id"),
+		Name:      get("name"),
+		Type:      get("type"),
+		Status:    get("status"),
+		Currency:  get("currency"),
+	}
+	line.Stamp = get("date") + " " + get("time")
+	if line.Date, err = imp.dates.Parse(get("date"), get("time"), get("timezone")); err != nil {
+		err = &FieldError{Column: "date", Err: err}
+		return
+	}
+	if line.Amount, err = ParseAmount(get("amount")); err != nil {
+		err = &FieldError{Column: "amount", Err: err}
+	}
+	return
+}
+
+// Process reads a PayPal activity export. Rows are grouped by their
+// timestamp; a group holds the payments made in that second plus the
+// deposit and currency conversion rows which funded them. Only completed
+// payments are booked. A payment in a foreign currency is booked for the
+// account currency amount found in its funding rows, with the original
+// amount in ForeignAmt. If there are no funding rows, the exchange rate
+// table is used. See fundedAmount for how funding rows are paired with
+// payments.
+func (imp *PayPalImporter) Process(txImport *TXImport) (err error) {
+	txImport.Reset()
+	return imp.ProcessLines(txImport, nil)
+}
+
+// ProcessLines imports the payments on the given line numbers, or all
+// payments if lines is nil.
+func (imp *PayPalImporter) ProcessLines(txImport *TXImport, lines map[int]bool) (err error) {
+	rdr := csv.NewReader(strings.NewReader(txImport.Data))
+	rdr.FieldsPerRecord = -1
+	var header []string
+	if header, err = rdr.Read(); err != nil {
+		return
+	}
+	if err = imp.parseHeader(header); err != nil {
+		return
+	}
+	imp.fingerprints = make(map[string]int)
+
+	groups := make([][]*payPalLine, 0)
+	stamps := make(map[string]int)
+	num := 1
+	for {
+		var record []string
+		if record, err = rdr.Read(); err != nil {
+			break
+		}
+		num++
+		var line *payPalLine
+		if line, err = imp.parseLine(num, record); err != nil {
+			if lines == nil || lines[num] {
+				txImport.Tally(num, record, err)
+			}
+			continue
+		}
+		ix, ok := stamps[line.Stamp]
+		if !ok {
+			ix = len(groups)
+			stamps[line.Stamp] = ix
+			groups = append(groups, make([]*payPalLine, 0))
+		}
+		groups[ix] = append(groups[ix], line)
+	}
+	if err != io.EOF {
+		return
+	}
+	err = nil
+
+	for _, group := range groups {
+		for _, line := range group {
+			if line.IsFunding() || line.Status != PayPalCompleted {
+				continue
+			}
+			if lines != nil && !lines[line.Line] {
+				if txp, _, e := imp.buildPayment(line, group); e == nil {
+					imp.ordinal(transaction(txp))
+				}
+				continue
+			}
+			txImport.Tally(line.Line, line.Raw, imp.SavePayment(txImport, line, group))
+		}
+	}
+	return
+}
+
+func (imp *PayPalImporter) currency() string {
+	return imp.Account.CurrencyCode()
+}
+
+// fundedAmount returns the amount in the account currency which was used to
+// fund a foreign currency payment, taken from the currency conversion or, if
+// there is none, the bank deposit for the payment. found is false if the
+// payment has no funding rows. Funding rows belong to the payment whose
+// transaction ID they reference. Exports without the transaction ID columns
+// only have the timestamp to go by, so if the group holds more than one
+// payment the funding rows cannot be paired and an error is returned.
+func (imp *PayPalImporter) fundedAmount(payment *payPalLine, group []*payPalLine) (amt model.Money, found bool, err error) {
+	var funding []*payPalLine
+	if payment.Id != "" {
+		for _, line := range group {
+			if line.IsFunding() && line.Reference == payment.Id {
+				funding = append(funding, line)
+			}
+		}
+	}
+	if funding == nil {
+		payments := 0
+		for _, line := range group {
+			if line.IsFunding() {
+				funding = append(funding, line)
+			} else {
+				payments++
+			}
+		}
+		if payments > 1 && len(funding) > 0 {
+			err = errors.New(fmt.Sprintf("%d payments at %s; cannot tell which funding rows belong to which payment", payments, payment.Stamp))
+			return
+		}
+	}
+	for _, fundingType := range []string{PayPalCurrencyConversion, PayPalBankDeposit} {
+		for _, line := range funding {
+			if line.Type == fundingType && line.Currency == imp.currency() {
+				amt, found = line.Amount.Abs(), true
+				return
+			}
+		}
+	}
+	return
+}
+
+func (imp *PayPalImporter) buildPayment(line *payPalLine, group []*payPalLine) (txp grumble.Persistable, fields map[string]string, err error) {
+	fields = make(map[string]string)
+	fields["contact"] = line.Name
+	fields["description"] = line.Name
+	if line.Name == "" {
+		fields["description"] = line.Type
+	}
+	fields["type"] = model.Debit
+	if line.Amount > 0 {
+		fields["type"] = model.Credit
+	}
+	imp.ApplyTemplates(fields, line.Amount)
+
+	if txp, err = imp.Account.MakeTransaction(fields["type"]); err != nil {
+		return
+	}
+	tx := transaction(txp)
+	if _, ok := txp.(*model.OpeningBalanceTx); ok || tx == nil {
+		err = errors.New(fmt.Sprintf("Cannot import PayPal line as transaction type %q", fields["type"]))
+		return
+	}
+	tx.Date = line.Date
+	tx.Description = fields["description"]
+	tx.Amt = line.Amount
+	tx.Currency = line.Currency
+	if line.Currency != imp.currency() {
+		// Payments from a foreign currency balance have no funding rows.
+		// These are converted using the exchange rate table when saved.
+		var amt model.Money
+		var found bool
+		if amt, found, err = imp.fundedAmount(line, group); err != nil {
+			return
+		}
+		if found {
+			tx.ForeignAmt = line.Amount
+			tx.Amt = amt
+			if line.Amount < 0 {
+				tx.Amt = -amt
+			}
+		}
+	}
+	return
+}
+
+func (imp *PayPalImporter) SavePayment(txImport *TXImport, line *payPalLine, group []*payPalLine) (err error) {
+	txp, fields, err := imp.buildPayment(line, group)
+	if err != nil {
+		return
+	}
+	if err = imp.checkDuplicate(txImport, txp, fields); err != nil {
+		return
+	}
+	return imp.Save(txImport, txp, fields)
+}
+
+func MakePayPalImporter(account *model.Account) (ret Importer, err error) {
+	imp := &PayPalImporter{CSVImporter: &CSVImporter{Account: account}}
+	if err = imp.parseTemplate(); err != nil {
+		return
+	}
+	formats, ok := imp.Config["dateformat"]
+	if !ok {
+		formats = PayPalDateFormat
+	}
+	zone, _ := imp.Config["timezone"].(string)
+	if imp.dates, err = MakeDateParser(formats, nil, zone); err == nil {
+		ret = imp
+	}
+	return
+}
+
+func init() {
+	importers["PayPal"] = MakePayPalImporter
+}
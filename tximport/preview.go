@@ -0,0 +1,145 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/grumble"
+	"time"
+)
+
+type PreviewLine struct {
+	Line        int
+	Date        time.Time
+	Amount      model.Money
+	Description string
+	Type        string
+	Template    string
+	Contact     string
+	Category    string
+	Project     string
+	Counter     string
+	Skipped     bool
+	Error       string
+}
+
+// ImportPreview collects what an import would do without committing it:
+// the transactions every line would produce, and the contacts, categories
+// and projects which would be created along the way.
+type ImportPreview struct {
+	FileName string
+	Total    int
+	Good     int
+	Bad      int
+	Skipped  int
+	Lines    []*PreviewLine
+	Created  map[string][]string
+	current  *PreviewLine
+}
+
+func MakeImportPreview() *ImportPreview {
+	return &ImportPreview{
+		Lines:   make([]*PreviewLine, 0),
+		Created: make(map[string][]string),
+	}
+}
+
+func transaction(txp grumble.Persistable) *model.Transaction {
+	switch tx := txp.(type) {
+	case *model.TransferTx:
+		return &tx.Transaction
+	case *model.OpeningBalanceTx:
+		return &tx.Transaction
+	case *model.Transaction:
+		return tx
+	}
+	return nil
+}
+
+// Record is called with the transaction and import fields of the line being
+// processed just before the transaction is stored.
+func (preview *ImportPreview) Record(txp grumble.Persistable, fields map[string]string) {
+	line := &PreviewLine{
+		Type:     fields["type"],
+		Template: fields["template"],
+		Contact:  fields["contact"],
+		Category: fields["category"],
+		Project:  fields["project"],
+		Counter:  fields["counter"],
+	}
+	if tx := transaction(txp); tx != nil {
+		line.Date = tx.Date
+		line.Amount = tx.Amt
+		line.Description = tx.Description
+	}
+	preview.current = line
+}
+
+// Tally closes the line being processed, using the result of booking it.
+func (preview *ImportPreview) Tally(num int, err error) {
+	line := preview.current
+	if line == nil {
+		line = &PreviewLine{}
+	}
+	preview.current = nil
+	line.Line = num
+	switch {
+	case err == ErrDuplicate:
+		line.Skipped = true
+	case err != nil:
+		line.Error = err.Error()
+	}
+	preview.Lines = append(preview.Lines, line)
+}
+
+func (preview *ImportPreview) AddCreated(kind string, name string) {
+	preview.Created[kind] = append(preview.Created[kind], name)
+}
+
+var errRollback = errors.New("Rollback")
+
+// Preview runs the import of the given file for the account in a database
+// transaction which is rolled back afterwards, and returns what the import
+// would have done.
+func Preview(account *model.Account, fileName string) (preview *ImportPreview, err error) {
+	preview = MakeImportPreview()
+	preview.FileName = fileName
+	err = account.Manager().TX(func(db *sql.DB) (err error) {
+		var txImport *TXImport
+		if txImport, err = MakeTXImport(account, fileName); err != nil {
+			return
+		}
+		txImport.preview = preview
+		if err = txImport.Read(); err != nil {
+			return
+		}
+		preview.Total = txImport.Total
+		preview.Good = txImport.Good
+		preview.Bad = txImport.Bad
+		preview.Skipped = txImport.Skipped
+		return errRollback
+	})
+	if err == errRollback {
+		err = nil
+	}
+	return
+}
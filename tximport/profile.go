@@ -0,0 +1,343 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/grumble"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// JSONText is a JSON document stored in a text column. It is marshalled as
+// the document itself and not as a string, so that profiles can be viewed
+// and edited as plain JSON through the /json/ API.
+type JSONText string
+
+func (text JSONText) MarshalJSON() ([]byte, error) {
+	if text == "" {
+		return []byte("null"), nil
+	}
+	return []byte(text), nil
+}
+
+func (text *JSONText) UnmarshalJSON(data []byte) error {
+	if !json.Valid(data) {
+		return errors.New(fmt.Sprintf("Invalid JSON %q", string(data)))
+	}
+	if string(data) == "null" {
+		*text = ""
+	} else {
+		*text = JSONText(data)
+	}
+	return nil
+}
+
+func (text *JSONText) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		*text = ""
+	case string:
+		*text = JSONText(s)
+	case []byte:
+		*text = JSONText(s)
+	default:
+		return errors.New(fmt.Sprintf("Cannot scan %T into JSONText", src))
+	}
+	return nil
+}
+
+func (text JSONText) Value() (driver.Value, error) {
+	return string(text), nil
+}
+
+func (text JSONText) SQLType() string {
+	return "TEXT"
+}
+
+func (text JSONText) decode(v interface{}) error {
+	if text == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(text), v)
+}
+
+func encodeJSONText(v interface{}) (text JSONText, err error) {
+	if v == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	text = JSONText(data)
+	return
+}
+
+// ImportProfile holds the column mapping, configuration and categorization
+// templates used to import transactions into its parent account. These used
+// to live in data/<AccName>.json, which is still read if the account does
+// not have a profile.
+type ImportProfile struct {
+	grumble.Key
+	Mapping   JSONText
+	Config    JSONText
+	Templates JSONText
+}
+
+// Data returns the profile in the same form as the profile files: an object
+// with "mapping", "config" and "templates" members.
+func (profile *ImportProfile) Data() (data map[string]interface{}, err error) {
+	data = make(map[string]interface{})
+	var mapping []interface{}
+	if err = profile.Mapping.decode(&mapping); err != nil {
+		return
+	}
+	if mapping != nil {
+		data["mapping"] = mapping
+	}
+	var config map[string]interface{}
+	if err = profile.Config.decode(&config); err != nil {
+		return
+	}
+	if config != nil {
+		data["config"] = config
+	}
+	var templates []interface{}
+	if err = profile.Templates.decode(&templates); err != nil {
+		return
+	}
+	if templates != nil {
+		data["templates"] = templates
+	}
+	return
+}
+
+func (profile *ImportProfile) SetData(data map[string]interface{}) (err error) {
+	if profile.Mapping, err = encodeJSONText(data["mapping"]); err != nil {
+		return
+	}
+	if profile.Config, err = encodeJSONText(data["config"]); err != nil {
+		return
+	}
+	profile.Templates, err = encodeJSONText(data["templates"])
+	return
+}
+
+// Validate checks that the profile can be used to import transactions,
+// i.e. that the mapping and config are well formed and all templates
+// compile.
+func (profile *ImportProfile) Validate() error {
+	data, err := profile.Data()
+	if err != nil {
+		return err
+	}
+	return (&CSVImporter{}).parseProfile(data)
+}
+
+func (profile *ImportProfile) ManyQuery(query *grumble.Query, values url.Values) (ret *grumble.Query) {
+	ret = model.AddAccountCondition(query, values)
+	return
+}
+
+// GetImportProfile returns the import profile of the account, or nil if the
+// account does not have one.
+func GetImportProfile(account *model.Account) (profile *ImportProfile, err error) {
+	q := account.Manager().MakeQuery(&ImportProfile{})
+	q.AddCondition(grumble.HasParent{Parent: account.AsKey()})
+	results, err := q.Execute()
+	if err != nil || len(results) == 0 {
+		return
+	}
+	profile = results[0][0].(*ImportProfile)
+	return
+}
+
+func profileFileName(dir string, account *model.Account) string {
+	return filepath.Join(dir, account.AccName+".json")
+}
+
+func readProfileFile(fileName string) (data map[string]interface{}, err error) {
+	var jsonText []byte
+	if jsonText, err = ioutil.ReadFile(fileName); err != nil {
+		return
+	}
+	if err = json.Unmarshal(jsonText, &data); err != nil {
+		err = errors.New(fmt.Sprintf("%s: %s", fileName, err))
+	}
+	return
+}
+
+// loadProfileData returns the import profile of the account. If the account
+// does not have a profile in the database, data/<AccName>.json is read.
+func loadProfileData(account *model.Account) (data map[string]interface{}, err error) {
+	profile, err := GetImportProfile(account)
+	if err != nil {
+		return
+	}
+	if profile != nil {
+		return profile.Data()
+	}
+	return readProfileFile(profileFileName("data", account))
+}
+
+// makeImportProfile creates a profile for the account from the profile file
+// in dir, or an empty one if there is no such file.
+func makeImportProfile(account *model.Account, dir string) (profile *ImportProfile, err error) {
+	profile = &ImportProfile{}
+	profile.Initialize(account, 0)
+	data, err := readProfileFile(profileFileName(dir, account))
+	switch {
+	case os.IsNotExist(err):
+		err = nil
+	case err == nil:
+		err = profile.SetData(data)
+	}
+	return
+}
+
+// MigrateImportProfiles creates import profiles from the profile files in dir
+// for all accounts which do not have a profile yet. Accounts without a
+// profile file are skipped.
+func MigrateImportProfiles(mgr *grumble.EntityManager, dir string) (count int, err error) {
+	accounts, err := model.GetAccounts(mgr, nil)
+	if err != nil {
+		return
+	}
+	for _, account := range accounts {
+		var profile *ImportProfile
+		if profile, err = GetImportProfile(account); err != nil {
+			return
+		}
+		if profile != nil {
+			continue
+		}
+		if _, err = os.Stat(profileFileName(dir, account)); os.IsNotExist(err) {
+			err = nil
+			continue
+		}
+		if profile, err = makeImportProfile(account, dir); err != nil {
+			return
+		}
+		if err = profile.Validate(); err != nil {
+			err = errors.New(fmt.Sprintf("Profile for %q: %s", account.AccName, err))
+			return
+		}
+		if err = mgr.Put(profile); err != nil {
+			return
+		}
+		count++
+	}
+	return
+}
+
+// AddTemplate appends a categorization template to the account's import
+// profile. If the account does not have a profile yet, it is created from
+// data/<AccName>.json first.
+func AddTemplate(account *model.Account, template map[string]interface{}) (profile *ImportProfile, err error) {
+	if _, err = MakeTemplate(template); err != nil {
+		return
+	}
+	if profile, err = GetImportProfile(account); err != nil {
+		return
+	}
+	if profile == nil {
+		if profile, err = makeImportProfile(account, "data"); err != nil {
+			return
+		}
+	}
+	var templates []interface{}
+	if err = profile.Templates.decode(&templates); err != nil {
+		return
+	}
+	if profile.Templates, err = encodeJSONText(append(templates, template)); err != nil {
+		return
+	}
+	err = account.Manager().Put(profile)
+	return
+}
+
+// ImportTemplates handles /account/templates/<id>. GET returns the templates
+// of the account's import profile, POST adds the template in the JSON body
+// and returns the updated list.
+func ImportTemplates(w http.ResponseWriter, r *http.Request) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, err := model.PathId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	account, err := model.GetAccount(mgr, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var profile *ImportProfile
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+		if profile, err = GetImportProfile(account); err == nil && profile == nil {
+			profile, err = makeImportProfile(account, "data")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodPost:
+		var template map[string]interface{}
+		if err = json.NewDecoder(r.Body).Decode(&template); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = mgr.TX(func(db *sql.DB) (err error) {
+			profile, err = AddTemplate(account, template)
+			return
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status = http.StatusCreated
+	default:
+		http.Error(w, "Templates can only be read using GET and added using POST", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonText, err := profile.Templates.MarshalJSON()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-type", "text/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(jsonText)
+}
+
+func init() {
+	grumble.GetKind(&ImportProfile{})
+}
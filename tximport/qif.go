@@ -0,0 +1,382 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/grumble"
+	"os"
+	"strings"
+	"time"
+)
+
+// QIF dates come in many shapes: 01/02/2019, 1/ 2/19 or 1/2'19. They are
+// normalized to slash separated fields without blanks before they are
+// parsed using these layouts. The layouts can be overridden by setting
+// "dateformat" in the config section of the account's import profile, using
+// strftime style formats.
+var QIFDateFormats = []string{"01/02/2006", "1/2/2006", "01/02/06", "1/2/06"}
+
+type QIFSplit struct {
+	Category string
+	Memo     string
+	Amount   string
+}
+
+type QIFRecord struct {
+	Line     int
+	Date     string
+	Amount   string
+	Payee    string
+	Memo     string
+	Number   string
+	Cleared  string
+	Category string
+	Splits   []*QIFSplit
+}
+
+// ParseQIF splits QIF data into records. Only records in bank, cash and
+// credit card sections are returned. If the data holds sections for multiple
+// accounts, only the records for the named account are returned.
+func ParseQIF(data string, account string) (records []*QIFRecord, err error) {
+	records = make([]*QIFRecord, 0)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	var section string
+	var accountName string
+	var inAccount bool
+	var rec *QIFRecord
+	var split *QIFSplit
+	num := 0
+	for scanner.Scan() {
+		num++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "!") {
+			header := strings.TrimSpace(line)
+			switch {
+			case strings.EqualFold(header, "!Account"):
+				inAccount = true
+			case strings.HasPrefix(strings.ToLower(header), "!type:"):
+				section = strings.ToLower(strings.TrimSpace(header[len("!type:"):]))
+			case strings.HasPrefix(strings.ToLower(header), "!option:"), strings.HasPrefix(strings.ToLower(header), "!clear:"):
+			default:
+				section = ""
+			}
+			continue
+		}
+		code, value := line[0], strings.TrimSpace(line[1:])
+		if inAccount {
+			switch code {
+			case 'N':
+				accountName = value
+			case '^':
+				inAccount = false
+			}
+			continue
+		}
+		switch section {
+		case "bank", "cash", "ccard", "oth a", "oth l":
+		default:
+			continue
+		}
+		if accountName != "" && account != "" && !strings.EqualFold(accountName, account) {
+			continue
+		}
+		if rec == nil {
+			rec = &QIFRecord{Line: num, Splits: make([]*QIFSplit, 0)}
+		}
+		switch code {
+		case 'D':
+			rec.Date = value
+		case 'T':
+			rec.Amount = value
+		case 'P':
+			rec.Payee = value
+		case 'M':
+			rec.Memo = value
+		case 'N':
+			rec.Number = value
+		case 'C':
+			rec.Cleared = value
+		case 'L':
+			rec.Category = value
+		case 'S':
+			split = &QIFSplit{Category: value}
+			rec.Splits = append(rec.Splits, split)
+		case 'E':
+			if split != nil {
+				split.Memo = value
+			}
+		case '$':
+			if split != nil {
+				split.Amount = value
+			}
+		case '^':
+			records = append(records, rec)
+			rec = nil
+			split = nil
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// ParseQIFCategory splits a QIF category into its parts. A category in
+// square brackets denotes a transfer to the named account. Otherwise the
+// category may be followed by a class, separated by a slash, which is mapped
+// to a project. Only the last component of Category:Subcategory is used,
+// since categories are looked up by name.
+func ParseQIFCategory(s string) (category string, project string, transfer string) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") {
+		if end := strings.Index(s, "]"); end > 0 {
+			transfer = strings.TrimSpace(s[1:end])
+			return
+		}
+	}
+	if slash := strings.Index(s, "/"); slash >= 0 {
+		project = strings.TrimSpace(s[slash+1:])
+		s = s[:slash]
+	}
+	if colon := strings.LastIndex(s, ":"); colon >= 0 {
+		s = s[colon+1:]
+	}
+	category = strings.TrimSpace(s)
+	return
+}
+
+func parseQIFAmount(s string) (model.Money, error) {
+	return ParseAmount(s)
+}
+
+type QIFImporter struct {
+	*CSVImporter
+	DateFormats []string
+}
+
+func (imp *QIFImporter) parseDate(s string) (t time.Time, err error) {
+	s = strings.Replace(strings.Replace(s, "'", "/", -1), " ", "", -1)
+	s = strings.Replace(s, "-", "/", -1)
+	for _, layout := range imp.DateFormats {
+		if t, err = time.Parse(layout, s); err == nil {
+			return
+		}
+	}
+	err = errors.New(fmt.Sprintf("Could not parse QIF date %q", s))
+	return
+}
+
+func (imp *QIFImporter) Process(txImport *TXImport) (err error) {
+	var records []*QIFRecord
+	if records, err = ParseQIF(txImport.Data, imp.Account.AccName); err != nil {
+		return
+	}
+	txImport.Reset()
+	return imp.processRecords(txImport, records, nil)
+}
+
+// ProcessLines imports the records starting on the given line numbers, or
+// all records if lines is nil.
+func (imp *QIFImporter) ProcessLines(txImport *TXImport, lines map[int]bool) (err error) {
+	var records []*QIFRecord
+	if records, err = ParseQIF(txImport.Data, imp.Account.AccName); err != nil {
+		return
+	}
+	return imp.processRecords(txImport, records, lines)
+}
+
+func (imp *QIFImporter) processRecords(txImport *TXImport, records []*QIFRecord, lines map[int]bool) (err error) {
+	for _, rec := range records {
+		if lines != nil && !lines[rec.Line] {
+			continue
+		}
+		raw := []string{rec.Date, rec.Amount, rec.Payee, rec.Memo, rec.Category}
+		txImport.Tally(rec.Line, raw, imp.SaveRecord(txImport, rec))
+	}
+	return
+}
+
+// SaveRecord books a QIF record. A split record is booked as one transaction
+// per split, so that every split can carry its own category. All splits are
+// prepared before any is stored, and they are stored in one database
+// transaction, so that a bad split does not leave half a record booked.
+// Splits which are transfers booked from the other account before are
+// skipped.
+func (imp *QIFImporter) SaveRecord(txImport *TXImport, rec *QIFRecord) (err error) {
+	var date time.Time
+	if date, err = imp.parseDate(rec.Date); err != nil {
+		err = &FieldError{Column: "date", Err: err}
+		return
+	}
+	var total model.Money
+	if total, err = parseQIFAmount(rec.Amount); err != nil {
+		err = &FieldError{Column: "amount", Err: err}
+		return
+	}
+	if len(rec.Splits) == 0 {
+		return imp.SavePosting(txImport, rec, date, total, rec.Category, rec.Memo)
+	}
+	var sum model.Money
+	for _, split := range rec.Splits {
+		var amt model.Money
+		if amt, err = parseQIFAmount(split.Amount); err != nil {
+			return
+		}
+		sum += amt
+	}
+	if sum != total {
+		return errors.New(fmt.Sprintf("Splits add up to %s instead of %s", sum, total))
+	}
+	postings := make([]*qifPosting, 0, len(rec.Splits))
+	for _, split := range rec.Splits {
+		amt, _ := parseQIFAmount(split.Amount)
+		memo := split.Memo
+		if memo == "" {
+			memo = rec.Memo
+		}
+		var posting *qifPosting
+		switch posting, err = imp.makePosting(rec, date, amt, split.Category, memo); {
+		case err == ErrDuplicate:
+			err = nil
+			continue
+		case err != nil:
+			return
+		}
+		postings = append(postings, posting)
+	}
+	if len(postings) == 0 {
+		return ErrDuplicate
+	}
+	return imp.Account.Manager().TX(func(db *sql.DB) (err error) {
+		for _, posting := range postings {
+			if err = imp.Save(txImport, posting.tx, posting.fields); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// qifPosting is a transaction prepared from a QIF record or split, with the
+// fields the templates set.
+type qifPosting struct {
+	tx     grumble.Persistable
+	fields map[string]string
+}
+
+func (imp *QIFImporter) SavePosting(txImport *TXImport, rec *QIFRecord, date time.Time, amt model.Money, qifCategory string, memo string) (err error) {
+	posting, err := imp.makePosting(rec, date, amt, qifCategory, memo)
+	if err != nil {
+		return
+	}
+	return imp.Save(txImport, posting.tx, posting.fields)
+}
+
+// makePosting prepares the transaction for a QIF record or split without
+// storing anything. Transfers which were booked from the other account
+// before return ErrDuplicate.
+func (imp *QIFImporter) makePosting(rec *QIFRecord, date time.Time, amt model.Money, qifCategory string, memo string) (posting *qifPosting, err error) {
+	fields := make(map[string]string)
+	fields["description"] = rec.Payee
+	if fields["description"] == "" {
+		fields["description"] = memo
+	}
+	fields["memo"] = memo
+	fields["number"] = rec.Number
+	fields["type"] = model.Debit
+	if amt > 0 {
+		fields["type"] = model.Credit
+	}
+	imp.ApplyTemplates(fields, amt)
+
+	category, project, transfer := ParseQIFCategory(qifCategory)
+	if category != "" {
+		fields["category"] = category
+	}
+	if project != "" {
+		fields["project"] = project
+	}
+	if transfer != "" {
+		var counter *model.Account
+		if counter, err = model.GetAccountByName(imp.Account.Manager(), transfer); err != nil {
+			return
+		}
+		var exists bool
+		if exists, err = imp.Account.HasTransfer(counter, date, amt); err != nil {
+			return
+		}
+		if exists {
+			err = ErrDuplicate
+			return
+		}
+		fields["type"] = model.Transfer
+		fields["counter"] = transfer
+	}
+
+	txp, err := imp.Account.MakeTransaction(fields["type"])
+	if err != nil {
+		return
+	}
+	var tx *model.Transaction
+	switch t := txp.(type) {
+	case *model.TransferTx:
+		tx = &t.Transaction
+	case *model.Transaction:
+		tx = t
+	default:
+		err = errors.New(fmt.Sprintf("Cannot import QIF record as transaction type %q", fields["type"]))
+		return
+	}
+	tx.Date = date
+	tx.Amt = amt
+	tx.Description = fields["description"]
+	tx.Consolidated = rec.Cleared == "X" || rec.Cleared == "R"
+	posting = &qifPosting{tx: txp, fields: fields}
+	return
+}
+
+// MakeQIFImporter returns an importer for QIF files. Like for OFX, the
+// template file for the account is optional.
+func MakeQIFImporter(account *model.Account) (ret Importer, err error) {
+	imp := &QIFImporter{CSVImporter: &CSVImporter{Account: account}, DateFormats: QIFDateFormats}
+	if err = imp.parseTemplate(); err != nil {
+		if !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+	}
+	if formats, ok := imp.Config["dateformat"]; ok {
+		if imp.DateFormats, err = layouts(formats); err != nil {
+			return
+		}
+	}
+	ret = imp
+	return
+}
+
+func init() {
+	importers["QIF"] = MakeQIFImporter
+}
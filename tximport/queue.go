@@ -0,0 +1,145 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"fmt"
+	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/grumble"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	QueueDir = "queue"
+	DoneDir  = "done"
+	ErrorDir = "error"
+)
+
+// Ingester polls the queue directories of all accounts, i.e.
+// <root>/<AccName>/queue, and imports every file it finds there. Files that
+// imported without errors are moved to the account's done directory. Files
+// which failed, either completely or partially, are moved to the error
+// directory. Since lines are fingerprinted, such a file can be moved back
+// into the queue after fixing the import profile without importing the good
+// lines twice. Files which cannot be moved out of the queue are not imported
+// again until they are changed.
+type Ingester struct {
+	Root     string
+	Interval time.Duration
+	stuck    map[string]time.Time
+}
+
+func MakeIngester(root string, interval time.Duration) *Ingester {
+	return &Ingester{Root: root, Interval: interval, stuck: make(map[string]time.Time)}
+}
+
+// Run scans the queue directories every Interval. It does not return, so it
+// should be started in its own goroutine.
+func (ingester *Ingester) Run() {
+	ticker := time.NewTicker(ingester.Interval)
+	defer ticker.Stop()
+	for {
+		if err := ingester.Scan(); err != nil {
+			log.Printf("Scanning import queues: %s", err)
+		}
+		<-ticker.C
+	}
+}
+
+// Scan imports all files currently in the queue directories.
+func (ingester *Ingester) Scan() (err error) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		return
+	}
+	accounts, err := model.GetAccounts(mgr, nil)
+	if err != nil {
+		return
+	}
+	for _, account := range accounts {
+		queue := filepath.Join(ingester.Root, account.AccName, QueueDir)
+		files, e := ioutil.ReadDir(queue)
+		if e != nil {
+			if !os.IsNotExist(e) {
+				log.Printf("Reading import queue %q: %s", queue, e)
+			}
+			continue
+		}
+		for _, file := range files {
+			// Skip files which may still be being written.
+			if file.IsDir() || time.Since(file.ModTime()) < 2*time.Second {
+				continue
+			}
+			fileName := filepath.Join(queue, file.Name())
+			if modTime, ok := ingester.stuck[fileName]; ok && modTime.Equal(file.ModTime()) {
+				continue
+			}
+			delete(ingester.stuck, fileName)
+			ingester.ingest(account, fileName, file.ModTime())
+		}
+	}
+	return
+}
+
+func (ingester *Ingester) ingest(account *model.Account, fileName string, modTime time.Time) {
+	target := ErrorDir
+	txImport, err := MakeTXImport(account, fileName)
+	if err == nil {
+		err = txImport.Read()
+	}
+	switch {
+	case err != nil:
+		log.Printf("Importing %q into %q: %s", fileName, account.AccName, err)
+	case txImport.Status == Completed:
+		target = DoneDir
+		log.Printf("Imported %q into %q: %d transactions, %d skipped",
+			fileName, account.AccName, txImport.Good, txImport.Skipped)
+	default:
+		log.Printf("Imported %q into %q with status %s: %d good, %d bad",
+			fileName, account.AccName, txImport.Status, txImport.Good, txImport.Bad)
+	}
+	if err = moveFile(fileName, filepath.Join(ingester.Root, account.AccName, target)); err != nil {
+		log.Printf("Moving %q to %q: %s. The file is not imported again until it is changed", fileName, target, err)
+		if ingester.stuck == nil {
+			ingester.stuck = make(map[string]time.Time)
+		}
+		ingester.stuck[fileName] = modTime
+	}
+}
+
+// moveFile moves the file into the directory. If the directory already holds
+// a file with the same name, a timestamp is added to the name.
+func moveFile(fileName string, dir string) (err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	base := filepath.Base(fileName)
+	target := filepath.Join(dir, base)
+	if _, e := os.Stat(target); e == nil {
+		ext := filepath.Ext(base)
+		target = filepath.Join(dir, fmt.Sprintf("%s-%s%s",
+			base[:len(base)-len(ext)], time.Now().Format("20060102150405"), ext))
+	}
+	return os.Rename(fileName, target)
+}
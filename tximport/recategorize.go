@@ -0,0 +1,328 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/JanDeVisser/finn/model"
+	"github.com/JanDeVisser/finn/render"
+	"github.com/JanDeVisser/grumble"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// FieldChange is a proposed change of the category, contact or project of a
+// transaction.
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// TransactionChanges are the changes proposed for one transaction by the
+// template it matched.
+type TransactionChanges struct {
+	TxId        int
+	Date        time.Time
+	Description string
+	Amt         model.Money
+	Template    string
+	Changes     []FieldChange
+}
+
+// Recategorization re-applies the templates of an account's import profile
+// to its stored transactions. Unless Overwrite is set, only the category,
+// contact and project of transactions which do not have one yet are set.
+// Reconciled transactions, transfers and opening balances are left alone.
+// If only is set, only transactions matched by the template with that name
+// or regular expression are changed. Unchecked lists the templates which
+// test fields some of the transactions do not have; see storedFields.
+type Recategorization struct {
+	Account      *model.Account
+	Overwrite    bool
+	Transactions []*TransactionChanges
+	Unchecked    []string
+	importer     *CSVImporter
+	txs          map[int]*model.Transaction
+	only         string
+}
+
+func MakeRecategorization(account *model.Account, overwrite bool) (r *Recategorization, err error) {
+	r = &Recategorization{Account: account, Overwrite: overwrite}
+	r.importer = &CSVImporter{Account: account}
+	err = r.importer.parseTemplate()
+	return
+}
+
+func referenceName(ref interface{}) string {
+	switch r := ref.(type) {
+	case *model.Category:
+		if r != nil {
+			return r.Name
+		}
+	case *model.Contact:
+		if r != nil {
+			return r.Name
+		}
+	case *model.Project:
+		if r != nil {
+			return r.Name
+		}
+	}
+	return ""
+}
+
+// transactionFields returns the fields templates are matched against for a
+// stored transaction which was not imported from a CSV line.
+func transactionFields(tx *model.Transaction) (fields map[string]string) {
+	fields = map[string]string{"description": tx.Description}
+	if contact := referenceName(tx.Contact); contact != "" {
+		fields["contact"] = contact
+	}
+	return
+}
+
+// storedFields rebuilds the fields templates are matched against for the
+// stored transactions of an account. Transactions imported by the CSV
+// importer get the columns of the line they were imported from, found by
+// their fingerprint. Other transactions only have the fields returned by
+// transactionFields, so templates testing other fields cannot be checked
+// against them.
+type storedFields struct {
+	lines      map[string]map[string]string
+	untestable map[int]bool
+}
+
+func makeStoredFields(imp *CSVImporter, imports []*TXImport) (stored *storedFields) {
+	stored = &storedFields{
+		lines:      make(map[string]map[string]string),
+		untestable: make(map[int]bool),
+	}
+	for ix := range imp.Templates {
+		for _, name := range imp.Templates[ix].fields(imp.matchOn()) {
+			if name != "description" && name != "contact" {
+				stored.untestable[ix] = true
+			}
+		}
+	}
+	if imp.Account.Importer != "CSV" {
+		return
+	}
+	for _, txImport := range imports {
+		if txImport == nil || txImport.Status == Undone {
+			continue
+		}
+		// Imports which cannot be read with the current profile are left
+		// out; their transactions only have their description and contact.
+		if lines, err := imp.lineFields(txImport); err == nil {
+			for id, fields := range lines {
+				stored.lines[id] = fields
+			}
+		}
+	}
+	return
+}
+
+// fields returns the fields for the transaction, and the templates which
+// cannot be checked against it by their index in Templates.
+func (stored *storedFields) fields(tx *model.Transaction) (fields map[string]string, untestable map[int]bool) {
+	if line, ok := stored.lines[tx.ExternalId]; ok && tx.ExternalId != "" {
+		fields = make(map[string]string, len(line))
+		for name, value := range line {
+			fields[name] = value
+		}
+		return
+	}
+	return transactionFields(tx), stored.untestable
+}
+
+// Propose determines the changes the templates make to the transactions of
+// the account.
+func (r *Recategorization) Propose() (err error) {
+	txs, err := r.Account.GetTransactions()
+	if err != nil {
+		return
+	}
+	imports, err := GetImports(r.Account)
+	if err != nil {
+		return
+	}
+	stored := makeStoredFields(r.importer, imports)
+	unchecked := make(map[int]bool)
+	r.Transactions = make([]*TransactionChanges, 0)
+	r.txs = make(map[int]*model.Transaction)
+	for _, tx := range txs {
+		if tx == nil || tx.Locked() || (tx.TXType != model.Debit && tx.TXType != model.Credit) {
+			continue
+		}
+		fields, untestable := stored.fields(tx)
+		for ix := range untestable {
+			unchecked[ix] = true
+		}
+		current := map[string]string{
+			"category": referenceName(tx.Category),
+			"contact":  referenceName(tx.Contact),
+			"project":  referenceName(tx.Project),
+		}
+		r.importer.ApplyTemplates(fields, tx.Amt)
+		if fields["template"] == "" || (r.only != "" && fields["template"] != r.only) {
+			continue
+		}
+		changes := make([]FieldChange, 0)
+		for _, field := range []string{"category", "contact", "project"} {
+			old, value := current[field], fields[field]
+			if value == "" || value == old || (old != "" && !r.Overwrite) {
+				continue
+			}
+			changes = append(changes, FieldChange{Field: field, Old: old, New: value})
+		}
+		if len(changes) > 0 {
+			r.Transactions = append(r.Transactions, &TransactionChanges{
+				TxId:        tx.Id(),
+				Date:        tx.Date,
+				Description: tx.Description,
+				Amt:         tx.Amt,
+				Template:    fields["template"],
+				Changes:     changes,
+			})
+			r.txs[tx.Id()] = tx
+		}
+	}
+	r.Unchecked = make([]string, 0, len(unchecked))
+	for ix := range r.importer.Templates {
+		if unchecked[ix] {
+			r.Unchecked = append(r.Unchecked, r.importer.Templates[ix].String())
+		}
+	}
+	return
+}
+
+// Apply proposes the changes and stores them in one database transaction.
+// It returns the number of transactions changed.
+func (r *Recategorization) Apply() (count int, err error) {
+	mgr := r.Account.Manager()
+	err = mgr.TX(func(db *sql.DB) (err error) {
+		if err = r.Propose(); err != nil {
+			return
+		}
+		kinds := map[string]interface{}{"category": &model.Category{}, "contact": &model.Contact{}, "project": &model.Project{}}
+		for _, changes := range r.Transactions {
+			tx := r.txs[changes.TxId]
+			for _, change := range changes.Changes {
+				var ref grumble.Persistable
+				if ref, _, err = findOrCreate(mgr, kinds[change.Field], "Name", change.New); err != nil {
+					return
+				}
+				setValueInObject(tx, change.Field, ref)
+			}
+			if err = mgr.Put(tx); err != nil {
+				return
+			}
+		}
+		count = len(r.Transactions)
+		return
+	})
+	return
+}
+
+func recategorizationFromValues(values url.Values) (recat *Recategorization, err error) {
+	mgr, err := grumble.MakeEntityManager()
+	if err != nil {
+		return
+	}
+	id, err := strconv.ParseInt(values.Get("accountid"), 0, 0)
+	if err != nil {
+		return
+	}
+	account, err := model.GetAccount(mgr, int(id))
+	if err != nil {
+		return
+	}
+	return MakeRecategorization(account, values.Get("overwrite") == "true")
+}
+
+// Recategorize is the /tools/recategorize?accountid=<id>&overwrite=true|false
+// tool. GET shows the changes the templates of the account would make, POST
+// applies them.
+func Recategorize(w http.ResponseWriter, r *http.Request) {
+	recat, err := recategorizationFromValues(r.URL.Query())
+	if err != nil {
+		model.RedirectError(w, r, err)
+		return
+	}
+	if r.Method == http.MethodPost {
+		count, err := recat.Apply()
+		if err != nil {
+			model.RedirectError(w, r, err)
+		} else {
+			model.RedirectSuccess(w, r, fmt.Sprintf("Recategorized %d transactions of %q", count, recat.Account.AccName))
+		}
+		return
+	}
+	if err = recat.Propose(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx := make(map[string]interface{})
+	ctx["Recategorization"] = recat
+	render.RenderTemplate(w, "recategorize", ctx)
+}
+
+// RecategorizeJSON is the JSON version of the recategorize tool, served at
+// /account/recategorize/<id>?overwrite=true|false. GET returns the proposed
+// changes, POST applies them and returns the changes made.
+func RecategorizeJSON(w http.ResponseWriter, r *http.Request) {
+	id, err := model.PathId(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	values := r.URL.Query()
+	values.Set("accountid", strconv.Itoa(id))
+	recat, err := recategorizationFromValues(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		err = recat.Propose()
+	case http.MethodPost:
+		_, err = recat.Apply()
+	default:
+		http.Error(w, "Recategorization supports GET and POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonText, err := json.Marshal(recat.Transactions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-type", "text/json")
+	_, _ = w.Write(jsonText)
+}
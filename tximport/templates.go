@@ -0,0 +1,349 @@
+/*
+ * This file is part of Finn.
+ *
+ * Copyright (c) 2019 Jan de Visser <jan@finiandarcy.com>
+ *
+ * Finn is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Finn is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Finn.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tximport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/JanDeVisser/finn/model"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Condition requires a field of an imported line to match a regular
+// expression.
+type Condition struct {
+	Field   string
+	Pattern string
+	re      *regexp.Regexp
+}
+
+// Template categorizes imported transactions. A template matches a line if
+// all of the following hold:
+//
+//	template    matches the field named by matchon, which defaults to the
+//	            "match" entry of the profile's config, or "description"
+//	conditions  an object of field names and regular expressions, which
+//	            must all match
+//	minamt      the absolute amount is at least minamt
+//	maxamt      the absolute amount is at most maxamt
+//	sign        "debit" or "credit"
+//
+// Regular expressions are case sensitive unless ignorecase is true.
+// Templates are tried in order of descending priority and then in the order
+// they appear in the profile. The first matching template sets each of type,
+// contact, category, project and counter; later matches only fill in values
+// which are still empty. A matching template with stop set ends the search.
+type Template struct {
+	Name       string
+	Template   string
+	MatchOn    string
+	Conditions []*Condition
+	MinAmt     *model.Money
+	MaxAmt     *model.Money
+	Sign       string
+	IgnoreCase bool
+	Priority   int
+	Stop       bool
+	Type       string
+	Contact    string
+	Category   string
+	Project    string
+	Counter    string
+	re         *regexp.Regexp
+}
+
+func templateString(def map[string]interface{}, key string) (s string, err error) {
+	switch v := def[key].(type) {
+	case string:
+		s = v
+	case nil:
+	default:
+		err = errors.New(fmt.Sprintf("Template %s must be a string", key))
+	}
+	return
+}
+
+func templateMoney(def map[string]interface{}, key string) (amt *model.Money, err error) {
+	var m model.Money
+	switch v := def[key].(type) {
+	case nil:
+		return
+	case float64:
+		m = model.MoneyFromFloat(v)
+	case string:
+		if m, err = model.ParseMoney(v); err != nil {
+			err = errors.New(fmt.Sprintf("Template %s: invalid amount %q", key, v))
+			return
+		}
+	default:
+		err = errors.New(fmt.Sprintf("Template %s must be an amount", key))
+		return
+	}
+	amt = &m
+	return
+}
+
+func templateBool(def map[string]interface{}, key string) (b bool, err error) {
+	switch v := def[key].(type) {
+	case bool:
+		b = v
+	case nil:
+	default:
+		err = errors.New(fmt.Sprintf("Template %s must be true or false", key))
+	}
+	return
+}
+
+func (tmpl *Template) compile(pattern string) (*regexp.Regexp, error) {
+	if tmpl.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// MakeTemplate creates a template from its definition in an import profile.
+// Keys are case insensitive; unknown keys are ignored.
+func MakeTemplate(definition map[string]interface{}) (ret Template, err error) {
+	def := make(map[string]interface{})
+	for key, value := range definition {
+		def[strings.ToLower(key)] = value
+	}
+	for key, s := range map[string]*string{
+		"name":     &ret.Name,
+		"template": &ret.Template,
+		"matchon":  &ret.MatchOn,
+		"sign":     &ret.Sign,
+		"type":     &ret.Type,
+		"contact":  &ret.Contact,
+		"category": &ret.Category,
+		"project":  &ret.Project,
+		"counter":  &ret.Counter,
+	} {
+		if *s, err = templateString(def, key); err != nil {
+			return
+		}
+	}
+	ret.MatchOn = strings.ToLower(ret.MatchOn)
+	ret.Sign = strings.ToLower(ret.Sign)
+	if ret.Sign != "" && ret.Sign != "debit" && ret.Sign != "credit" {
+		err = errors.New(fmt.Sprintf("Template sign must be \"debit\" or \"credit\", not %q", ret.Sign))
+		return
+	}
+	if ret.MinAmt, err = templateMoney(def, "minamt"); err != nil {
+		return
+	}
+	if ret.MaxAmt, err = templateMoney(def, "maxamt"); err != nil {
+		return
+	}
+	if ret.IgnoreCase, err = templateBool(def, "ignorecase"); err != nil {
+		return
+	}
+	if ret.Stop, err = templateBool(def, "stop"); err != nil {
+		return
+	}
+	switch p := def["priority"].(type) {
+	case float64:
+		ret.Priority = int(p)
+	case nil:
+	default:
+		err = errors.New("Template priority must be a number")
+		return
+	}
+	if ret.re, err = ret.compile(ret.Template); err != nil {
+		return
+	}
+	switch c := def["conditions"].(type) {
+	case map[string]interface{}:
+		ret.Conditions = make([]*Condition, 0, len(c))
+		for field, p := range c {
+			pattern, ok := p.(string)
+			if !ok {
+				err = errors.New(fmt.Sprintf("Template condition on %q must be a regular expression", field))
+				return
+			}
+			condition := &Condition{Field: strings.ToLower(field), Pattern: pattern}
+			if condition.re, err = ret.compile(pattern); err != nil {
+				return
+			}
+			ret.Conditions = append(ret.Conditions, condition)
+		}
+		sort.Slice(ret.Conditions, func(i, j int) bool {
+			return ret.Conditions[i].Field < ret.Conditions[j].Field
+		})
+	case nil:
+	default:
+		err = errors.New("Template conditions must be an object")
+	}
+	return
+}
+
+// String identifies the template in previews and reports: its name, its
+// regular expression, or its conditions.
+func (tmpl *Template) String() string {
+	switch {
+	case tmpl.Name != "":
+		return tmpl.Name
+	case tmpl.Template != "":
+		return tmpl.Template
+	}
+	conditions := make([]string, len(tmpl.Conditions))
+	for ix, condition := range tmpl.Conditions {
+		conditions[ix] = condition.Field + "~" + condition.Pattern
+	}
+	return strings.Join(conditions, " & ")
+}
+
+// fields returns the names of the fields the template tests.
+func (tmpl *Template) fields(matchOn string) (names []string) {
+	if tmpl.Template != "" {
+		if tmpl.MatchOn != "" {
+			matchOn = tmpl.MatchOn
+		}
+		names = append(names, matchOn)
+	}
+	for _, condition := range tmpl.Conditions {
+		names = append(names, condition.Field)
+	}
+	return
+}
+
+func (tmpl *Template) matches(fields map[string]string, amt model.Money, matchOn string) bool {
+	if tmpl.Template != "" {
+		if tmpl.MatchOn != "" {
+			matchOn = tmpl.MatchOn
+		}
+		v, ok := fields[matchOn]
+		if !ok || !tmpl.re.MatchString(v) {
+			return false
+		}
+	}
+	for _, condition := range tmpl.Conditions {
+		v, ok := fields[condition.Field]
+		if !ok || !condition.re.MatchString(v) {
+			return false
+		}
+	}
+	if tmpl.MinAmt != nil && amt.Abs() < *tmpl.MinAmt {
+		return false
+	}
+	if tmpl.MaxAmt != nil && amt.Abs() > *tmpl.MaxAmt {
+		return false
+	}
+	switch tmpl.Sign {
+	case "debit":
+		return amt < 0
+	case "credit":
+		return amt > 0
+	}
+	return true
+}
+
+// matchOn returns the field templates without matchon are matched against.
+func (imp *CSVImporter) matchOn() string {
+	if m, ok := imp.Config["match"].(string); ok && m != "" {
+		return strings.ToLower(m)
+	}
+	return "description"
+}
+
+// ApplyTemplates sets the type, contact, category, project and counter
+// fields of an imported line with amount amt from the matching templates.
+func (imp *CSVImporter) ApplyTemplates(fields map[string]string, amt model.Money) {
+	imp.applyTemplates(fields, amt, nil)
+}
+
+// applyTemplates applies the templates and, if observe is not nil, reports
+// every matching template with its index in Templates and whether it set any
+// field. Templates matching after a template with stop set are reported as
+// not effective.
+func (imp *CSVImporter) applyTemplates(fields map[string]string, amt model.Money, observe func(ix int, effective bool)) {
+	matchOn := imp.matchOn()
+	set := make(map[string]bool)
+	stopped := false
+	for ix := range imp.Templates {
+		tmpl := &imp.Templates[ix]
+		if !tmpl.matches(fields, amt, matchOn) {
+			continue
+		}
+		if stopped {
+			observe(ix, false)
+			continue
+		}
+		effective := false
+		if !set["template"] {
+			fields["template"] = tmpl.String()
+			set["template"] = true
+			effective = true
+		}
+		for name, value := range map[string]string{
+			"type":     tmpl.Type,
+			"contact":  tmpl.Contact,
+			"category": tmpl.Category,
+			"project":  tmpl.Project,
+			"counter":  tmpl.Counter,
+		} {
+			if value != "" && !set[name] {
+				fields[name] = value
+				set[name] = true
+				effective = true
+			}
+		}
+		if observe != nil {
+			observe(ix, effective)
+		}
+		if tmpl.Stop {
+			if observe == nil {
+				break
+			}
+			stopped = true
+		}
+	}
+}
+
+// lineAmount returns the amount of a CSV line for matching templates, from
+// the amt column or the debit and credit columns. Amounts which cannot be
+// parsed are taken as zero; they are reported when the transaction is built.
+func (imp *CSVImporter) lineAmount(fields map[string]string) (amt model.Money) {
+	for _, mapping := range imp.Mappings {
+		if mapping == nil || (mapping.Type != "money" && mapping.Type != "float") {
+			continue
+		}
+		s := strings.TrimSpace(fields[mapping.Name])
+		if s == "" {
+			continue
+		}
+		val, err := mapping.Convert(s)
+		m, ok := val.(model.Money)
+		if err != nil || !ok {
+			continue
+		}
+		switch mapping.Name {
+		case "amt", "amount":
+			amt = m
+		case "debit":
+			amt -= m.Abs()
+		case "credit":
+			amt += m.Abs()
+		}
+	}
+	return
+}